@@ -0,0 +1,88 @@
+package config
+
+import (
+    "os"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "time"
+)
+
+type Config struct {
+    // Reproducible archives
+    ReproducibleMtime int64 // Unix timestamp stamped on every archive entry
+    ReproducibleUID   int   // Numeric owner stamped on every archive entry
+    ReproducibleGID   int   // Numeric group stamped on every archive entry
+
+    // Path sandboxing. Both lists are required, the server refuses to start without them.
+    AllowedSourceRoots      []string // Directories jobs may read from
+    AllowedDestinationRoots []string // Directories jobs may write to
+
+    // Integrity scrubbing
+    ScrubInterval time.Duration // How often stored backups are re-verified, 0 disables
+
+    // Job scheduling
+    BackupWorkers   int // Backups running at once, the rest wait in a queue
+    MediaWorkers    int // Media jobs running at once
+    FFmpegProcesses int // ffmpeg processes running at once across every media job, files and chunks included
+
+    // Media presets
+    MediaPresetsFile string // JSON file presets are kept in, empty keeps them in memory only
+}
+
+// Load reads the configuration from the environment, falling back to
+// defaults for anything that is not set.
+func Load() *Config {
+    return &Config{
+        // SOURCE_DATE_EPOCH is the conventional way to pin build timestamps
+        ReproducibleMtime: getEnvInt64("REPRODUCIBLE_MTIME", getEnvInt64("SOURCE_DATE_EPOCH", 0)),
+        ReproducibleUID:   int(getEnvInt64("REPRODUCIBLE_UID", 0)),
+        ReproducibleGID:   int(getEnvInt64("REPRODUCIBLE_GID", 0)),
+
+        AllowedSourceRoots:      getEnvList("ALLOWED_SOURCE_ROOTS"),
+        AllowedDestinationRoots: getEnvList("ALLOWED_DESTINATION_ROOTS"),
+
+        ScrubInterval: getEnvDuration("SCRUB_INTERVAL", 24*time.Hour),
+
+        BackupWorkers:   int(getEnvInt64("BACKUP_WORKERS", 2)),
+        MediaWorkers:    int(getEnvInt64("MEDIA_WORKERS", 1)),
+        FFmpegProcesses: int(getEnvInt64("FFMPEG_PROCESSES", int64(runtime.NumCPU()))),
+
+        MediaPresetsFile: os.Getenv("MEDIA_PRESETS_FILE"),
+    }
+}
+
+// getEnvList splits a PATH-style (colon separated) variable
+func getEnvList(key string) []string {
+    var list []string
+    for _, item := range filepath.SplitList(os.Getenv(key)) {
+        if item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
+}
+
+func getEnvInt64(key string, fallback int64) int64 {
+    value := os.Getenv(key)
+    if value == "" {
+        return fallback
+    }
+    parsed, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+        return fallback
+    }
+    return parsed
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return fallback
+    }
+    parsed, err := time.ParseDuration(value)
+    if err != nil {
+        return fallback
+    }
+    return parsed
+}
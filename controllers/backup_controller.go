@@ -1,24 +1,45 @@
 package controllers
 
 import (
+    "crypto/sha256"
+    "encoding/hex"
     "fmt"
+    "io"
+    "os"
     "os/exec"
     "path/filepath"
+    "strings"
+    "sync"
     "time"
     "log"
     "github.com/gofiber/fiber/v2"
     "github.com/google/uuid"
+    "task-automation-rig/config"
     "task-automation-rig/models"
 )
 
 type BackupController struct {
-    backups map[string]*models.Backup
+    config    *config.Config
+    sandbox   *pathSandbox
+    scheduler *Scheduler
+    mu        sync.RWMutex
+    backups   map[string]*models.Backup
+    scrubbing sync.Mutex // Held while a scrub pass runs
 }
 
-func NewBackupController() *BackupController {
-    return &BackupController{
-        backups: make(map[string]*models.Backup),
+func NewBackupController(cfg *config.Config, scheduler *Scheduler) *BackupController {
+    c := &BackupController{
+        config:    cfg,
+        sandbox:   newPathSandbox(cfg.AllowedSourceRoots, cfg.AllowedDestinationRoots),
+        scheduler: scheduler,
+        backups:   make(map[string]*models.Backup),
     }
+
+    if cfg.ScrubInterval > 0 {
+        go c.runScrubber(cfg.ScrubInterval)
+    }
+
+    return c
 }
 
 // CreateBackup initiates a new backup job
@@ -37,6 +58,24 @@ func (c *BackupController) CreateBackup(ctx *fiber.Ctx) error {
         })
     }
 
+    // Only tar lets us pin entry order, ownership and timestamps
+    if request.Reproducible && !request.CompressionType.IsTar() {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Reproducible archives are only supported for tar formats",
+        })
+    }
+
+    if request.ParityPercent < 0 || request.ParityPercent > 100 {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Parity percent must be between 0 and 100",
+        })
+    }
+    if request.ParityPercent > 0 && request.CompressionType == models.Snapshot {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Parity is only supported for archives",
+        })
+    }
+
     // Generate timestamp for the backup filename
     timestamp := time.Now().Format("2006-01-02_15-04-05")
     
@@ -60,6 +99,8 @@ func (c *BackupController) CreateBackup(ctx *fiber.Ctx) error {
         newFilename = fmt.Sprintf("backup_%s.7z", timestamp)
     case models.Rar:
         newFilename = fmt.Sprintf("backup_%s.rar", timestamp)
+    case models.Snapshot:
+        newFilename = fmt.Sprintf("backup_%s", timestamp)
     default:
         newFilename = fmt.Sprintf("backup_%s.tar.gz", timestamp)
     }
@@ -67,28 +108,54 @@ func (c *BackupController) CreateBackup(ctx *fiber.Ctx) error {
     // Combine the directory with the new filename
     request.DestinationPath = filepath.Join(destDir, newFilename)
 
+    // Confine reads and writes to the configured roots
+    for i, path := range request.Paths {
+        resolved, err := c.sandbox.checkSource(path)
+        if err != nil {
+            return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+                "error": err.Error(),
+            })
+        }
+        request.Paths[i] = resolved
+    }
+    resolvedDest, err := c.sandbox.checkDestination(request.DestinationPath)
+    if err != nil {
+        return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    }
+    request.DestinationPath = resolvedDest
+
     // Create backup record
     backup := &models.Backup{
         ID:              uuid.New().String(),
         Paths:           request.Paths,
         DestinationPath: request.DestinationPath,
         CompressionType: request.CompressionType,
-        Status:          "pending",
+        Reproducible:    request.Reproducible,
+        ParityPercent:   request.ParityPercent,
+        Status:          "queued",
         StartTime:       time.Now(),
     }
 
     // Store backup record
+    c.mu.Lock()
     c.backups[backup.ID] = backup
+    c.mu.Unlock()
 
-    // Start backup process asynchronously
-    go c.processBackup(backup)
+    // Run the backup once a worker is free
+    c.scheduler.submit(backupJobs, backup.ID, func() { c.processBackup(backup) })
 
-    return ctx.Status(fiber.StatusAccepted).JSON(backup)
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return ctx.Status(fiber.StatusAccepted).JSON(c.backupView(backup))
 }
 
 // GetBackup returns the status of a specific backup job
 func (c *BackupController) GetBackup(ctx *fiber.Ctx) error {
     id := ctx.Params("id")
+    c.mu.RLock()
+    defer c.mu.RUnlock()
     backup, exists := c.backups[id]
     if !exists {
         return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
@@ -96,20 +163,57 @@ func (c *BackupController) GetBackup(ctx *fiber.Ctx) error {
         })
     }
 
-    return ctx.JSON(backup)
+    return ctx.JSON(c.backupView(backup))
 }
 
 // ListBackups returns all backup jobs
 func (c *BackupController) ListBackups(ctx *fiber.Ctx) error {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    backupList := make([]backupView, 0, len(c.backups))
+    for _, backup := range c.backups {
+        backupList = append(backupList, c.backupView(backup))
+    }
+    return ctx.JSON(backupList)
+}
+
+// backupView is a backup as the API returns it. Callers hold mu so the
+// record is read whole; the queue position is looked up per response.
+type backupView struct {
+    *models.Backup
+    QueuePosition int `json:"queuePosition,omitempty"` // Place in the backup queue while queued
+}
+
+func (c *BackupController) backupView(backup *models.Backup) backupView {
+    return backupView{Backup: backup, QueuePosition: c.scheduler.position(backupJobs, backup.ID)}
+}
+
+func (c *BackupController) listBackups() []*models.Backup {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
     backupList := make([]*models.Backup, 0, len(c.backups))
     for _, backup := range c.backups {
         backupList = append(backupList, backup)
     }
-    return ctx.JSON(backupList)
+    return backupList
+}
+
+// finishBackup records the outcome of a backup. State is only written
+// under mu, the scrubber and the handlers read it concurrently.
+func (c *BackupController) finishBackup(backup *models.Backup, status, errMsg string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    backup.Status = status
+    backup.Error = errMsg
+    backup.EndTime = time.Now()
 }
 
 func (c *BackupController) processBackup(backup *models.Backup) {
+    c.mu.Lock()
     backup.Status = "in_progress"
+    c.mu.Unlock()
     log.Printf("Starting backup process for ID: %s\n", backup.ID)
     log.Printf("Source paths: %v\n", backup.Paths)
     log.Printf("Destination: %s\n", backup.DestinationPath)
@@ -118,9 +222,7 @@ func (c *BackupController) processBackup(backup *models.Backup) {
     destDir := filepath.Dir(backup.DestinationPath)
     if err := exec.Command("mkdir", "-p", destDir).Run(); err != nil {
         log.Printf("Failed to create directory: %s\n", err)
-        backup.Status = "failed"
-        backup.Error = err.Error()
-        backup.EndTime = time.Now()
+        c.finishBackup(backup, "failed", err.Error())
         return
     }
 
@@ -130,45 +232,62 @@ func (c *BackupController) processBackup(backup *models.Backup) {
     
     switch backup.CompressionType {
     case models.Tar:
-        args := append([]string{"-cvf", backup.DestinationPath}, backup.Paths...)
+        args := c.tarArgs(backup, "-cvf", "")
         cmd = exec.Command("tar", args...)
-        cmdStr = fmt.Sprintf("tar -cvf %s %v", backup.DestinationPath, backup.Paths)
+        cmdStr = fmt.Sprintf("tar %s", strings.Join(args, " "))
     
     case models.TarGz:
-        args := append([]string{"-czf", backup.DestinationPath}, backup.Paths...)
+        // gzip -n leaves the original name and timestamp out of the header
+        args := c.tarArgs(backup, "-czf", "gzip -n")
         cmd = exec.Command("tar", args...)
-        cmdStr = fmt.Sprintf("tar -czf %s %v", backup.DestinationPath, backup.Paths)
+        cmdStr = fmt.Sprintf("tar %s", strings.Join(args, " "))
     
     case models.TarBz2:
-        args := append([]string{"-cjf", backup.DestinationPath}, backup.Paths...)
+        // bzip2 output carries no timestamps, so it is already deterministic
+        args := c.tarArgs(backup, "-cjf", "")
         cmd = exec.Command("tar", args...)
-        cmdStr = fmt.Sprintf("tar -cjf %s %v", backup.DestinationPath, backup.Paths)
+        cmdStr = fmt.Sprintf("tar %s", strings.Join(args, " "))
     
     case models.TarXz:
-        args := append([]string{"-cJf", backup.DestinationPath}, backup.Paths...)
+        // Multi-threaded xz splits blocks differently depending on core count
+        args := c.tarArgs(backup, "-cJf", "xz -T1")
         cmd = exec.Command("tar", args...)
-        cmdStr = fmt.Sprintf("tar -cJf %s %v", backup.DestinationPath, backup.Paths)
+        cmdStr = fmt.Sprintf("tar %s", strings.Join(args, " "))
     
     case models.Zip:
-        args := append([]string{"-r", backup.DestinationPath}, backup.Paths...)
+        // -y stores symlinks as links instead of following them out of the sandbox
+        args := append([]string{"-r", "-y", backup.DestinationPath}, backup.Paths...)
         cmd = exec.Command("zip", args...)
-        cmdStr = fmt.Sprintf("zip -r %s %v", backup.DestinationPath, backup.Paths)
+        cmdStr = fmt.Sprintf("zip -r -y %s %v", backup.DestinationPath, backup.Paths)
     
     case models.SevenZ:
-        args := append([]string{"a", backup.DestinationPath}, backup.Paths...)
+        args := append([]string{"a", "-snl", backup.DestinationPath}, backup.Paths...)
         cmd = exec.Command("7z", args...)
-        cmdStr = fmt.Sprintf("7z a %s %v", backup.DestinationPath, backup.Paths)
+        cmdStr = fmt.Sprintf("7z a -snl %s %v", backup.DestinationPath, backup.Paths)
     
     case models.Rar:
-        args := append([]string{"a", backup.DestinationPath}, backup.Paths...)
+        args := append([]string{"a", "-ol", backup.DestinationPath}, backup.Paths...)
         cmd = exec.Command("rar", args...)
-        cmdStr = fmt.Sprintf("rar a %s %v", backup.DestinationPath, backup.Paths)
+        cmdStr = fmt.Sprintf("rar a -ol %s %v", backup.DestinationPath, backup.Paths)
+    
+    case models.Snapshot:
+        // rsnapshot style: --link-dest hard-links files unchanged since the
+        // previous snapshot, --relative keeps each source's full path apart
+        args := []string{"-a", "--relative"}
+        if previous := c.previousSnapshot(backup.DestinationPath); previous != "" {
+            log.Printf("Hard-linking unchanged files from: %s\n", previous)
+            c.mu.Lock()
+            backup.LinkedFrom = previous
+            c.mu.Unlock()
+            args = append(args, "--link-dest="+previous)
+        }
+        args = append(append(args, backup.Paths...), backup.DestinationPath+"/")
+        cmd = exec.Command("rsync", args...)
+        cmdStr = fmt.Sprintf("rsync %s", strings.Join(args, " "))
     
     default:
         log.Printf("Unsupported compression type: %s\n", backup.CompressionType)
-        backup.Status = "failed"
-        backup.Error = "unsupported compression type"
-        backup.EndTime = time.Now()
+        c.finishBackup(backup, "failed", "unsupported compression type")
         return
     }
 
@@ -179,13 +298,99 @@ func (c *BackupController) processBackup(backup *models.Backup) {
     if err != nil {
         log.Printf("Command failed: %s\n", err)
         log.Printf("Command output: %s\n", string(output))
-        backup.Status = "failed"
-        backup.Error = fmt.Sprintf("Command failed: %s. Output: %s", err, string(output))
-    } else {
-        log.Printf("Command completed successfully\n")
-        log.Printf("Command output: %s\n", string(output))
-        backup.Status = "completed"
+        c.finishBackup(backup, "failed", fmt.Sprintf("Command failed: %s. Output: %s", err, string(output)))
+        return
     }
+    log.Printf("Command completed successfully\n")
+    log.Printf("Command output: %s\n", string(output))
 
-    backup.EndTime = time.Now()
+    // Checksum and parity are in place before the backup reads as completed
+    var checksum, parityPath, errMsg string
+    if backup.CompressionType != models.Snapshot {
+        // Snapshots are directory trees, only archives get a checksum
+        if checksum, err = fileChecksum(backup.DestinationPath); err != nil {
+            log.Printf("Failed to checksum archive: %s\n", err)
+        }
+    }
+    if backup.ParityPercent > 0 {
+        if parityPath, err = createParity(backup); err != nil {
+            log.Printf("Failed to create parity: %s\n", err)
+            errMsg = err.Error()
+        }
+    }
+
+    c.mu.Lock()
+    backup.Checksum = checksum
+    backup.ParityPath = parityPath
+    c.mu.Unlock()
+    c.finishBackup(backup, "completed", errMsg)
+}
+
+// tarArgs builds the tar arguments for a backup. Reproducible backups sort
+// entries, pin ownership and mtimes to the configured values and, when a
+// compressor is given, pipe through it instead of the built-in flag so its
+// header carries no timestamp.
+func (c *BackupController) tarArgs(backup *models.Backup, flags string, compressor string) []string {
+    var args []string
+    if backup.Reproducible {
+        args = append(args,
+            "--sort=name",
+            "--format=gnu",
+            fmt.Sprintf("--mtime=@%d", c.config.ReproducibleMtime),
+            fmt.Sprintf("--owner=%d", c.config.ReproducibleUID),
+            fmt.Sprintf("--group=%d", c.config.ReproducibleGID),
+            "--numeric-owner",
+        )
+        if compressor != "" {
+            args = append(args, "--use-compress-program="+compressor)
+            flags = "-cf"
+        }
+    }
+    args = append(args, flags, backup.DestinationPath)
+    return append(args, backup.Paths...)
+}
+
+// previousSnapshot returns the newest completed snapshot from the catalog
+// that sits next to the given one, or "" when there is none. A snapshot
+// that failed or is still being written may be missing files, linking
+// against it would copy them again at best. Snapshot names embed a
+// sortable timestamp, so the newest is the greatest name below ours.
+func (c *BackupController) previousSnapshot(snapshotPath string) string {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    dir := filepath.Dir(snapshotPath)
+    current := filepath.Base(snapshotPath)
+    previous := ""
+    for _, backup := range c.backups {
+        if backup.CompressionType != models.Snapshot || backup.Status != "completed" {
+            continue
+        }
+        name := filepath.Base(backup.DestinationPath)
+        if filepath.Dir(backup.DestinationPath) != dir || name >= current {
+            continue
+        }
+        if name > previous {
+            previous = name
+        }
+    }
+    if previous == "" {
+        return ""
+    }
+    return filepath.Join(dir, previous)
+}
+
+// fileChecksum returns the hex encoded SHA-256 of a file
+func fileChecksum(path string) (string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    hash := sha256.New()
+    if _, err := io.Copy(hash, file); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
 }
\ No newline at end of file
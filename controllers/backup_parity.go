@@ -0,0 +1,93 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "os/exec"
+    "github.com/gofiber/fiber/v2"
+    "task-automation-rig/models"
+)
+
+// RepairBackup queues a rebuild of the damaged blocks of an archive from
+// its parity files. Only finished backups are repaired, never one that is
+// still being written.
+func (c *BackupController) RepairBackup(ctx *fiber.Ctx) error {
+    id := ctx.Params("id")
+    c.mu.Lock()
+    backup, exists := c.backups[id]
+    if !exists {
+        c.mu.Unlock()
+        return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+            "error": "Backup not found",
+        })
+    }
+    if backup.ParityPath == "" {
+        c.mu.Unlock()
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Backup has no parity data",
+        })
+    }
+    status := backup.Status
+    if status != "completed" && status != "corrupted" {
+        c.mu.Unlock()
+        return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{
+            "error": fmt.Sprintf("Only finished backups can be repaired, backup is %s", status),
+        })
+    }
+    backup.Status = "repairing"
+    c.mu.Unlock()
+
+    // par2 reads the whole archive, it waits for a worker like a backup
+    c.scheduler.submit(backupJobs, backup.ID, func() { c.repairBackup(backup, status) })
+
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return ctx.Status(fiber.StatusAccepted).JSON(c.backupView(backup))
+}
+
+// repairBackup runs par2 over a backup and confirms the result against the
+// creation checksum. A failed repair leaves the backup as it was found.
+func (c *BackupController) repairBackup(backup *models.Backup, previous string) {
+    log.Printf("Repairing backup %s from %s\n", backup.ID, backup.ParityPath)
+    output, err := exec.Command("par2", "repair", "-q", backup.ParityPath).CombinedOutput()
+    if err != nil {
+        log.Printf("Repair failed: %s\n", err)
+        c.setRepairOutcome(backup, previous, fmt.Sprintf("Repair failed: %s. Output: %s", err, string(output)))
+        return
+    }
+
+    // par2 verified the data blocks, confirm against the creation checksum too
+    checksum, err := fileChecksum(backup.DestinationPath)
+    if err != nil {
+        c.setRepairOutcome(backup, previous, err.Error())
+        return
+    }
+    if backup.Checksum != "" && checksum != backup.Checksum {
+        c.setRepairOutcome(backup, previous, "Repaired archive does not match the recorded checksum")
+        return
+    }
+
+    c.setRepairOutcome(backup, "completed", "")
+    log.Printf("Backup %s repaired\n", backup.ID)
+}
+
+func (c *BackupController) setRepairOutcome(backup *models.Backup, status, errMsg string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    backup.Status = status
+    backup.Error = errMsg
+}
+
+// createParity writes Reed-Solomon recovery files next to the archive and
+// returns the path of their index
+func createParity(backup *models.Backup) (string, error) {
+    parityPath := backup.DestinationPath + ".par2"
+    redundancy := fmt.Sprintf("-r%d", backup.ParityPercent)
+
+    log.Printf("Executing command: par2 create -q %s %s %s\n", redundancy, parityPath, backup.DestinationPath)
+    output, err := exec.Command("par2", "create", "-q", redundancy, parityPath, backup.DestinationPath).CombinedOutput()
+    if err != nil {
+        return "", fmt.Errorf("parity creation failed: %s. Output: %s", err, string(output))
+    }
+    return parityPath, nil
+}
@@ -0,0 +1,150 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "time"
+    "github.com/gofiber/fiber/v2"
+    "task-automation-rig/models"
+)
+
+// ScrubBackups starts an immediate scrub pass over all stored backups
+func (c *BackupController) ScrubBackups(ctx *fiber.Ctx) error {
+    go c.scrubAll()
+    return ctx.Status(fiber.StatusAccepted).JSON(fiber.Map{
+        "message": "Scrub started",
+    })
+}
+
+// GetScrubReport returns the last scrub time and outcome for each backup
+func (c *BackupController) GetScrubReport(ctx *fiber.Ctx) error {
+    backups := c.listBackups()
+
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    report := make([]models.ScrubReport, 0, len(backups))
+    for _, backup := range backups {
+        report = append(report, models.ScrubReport{
+            BackupID:        backup.ID,
+            DestinationPath: backup.DestinationPath,
+            Status:          backup.Status,
+            LastScrubTime:   backup.LastScrubTime,
+            Outcome:         backup.ScrubOutcome,
+            Error:           backup.ScrubError,
+        })
+    }
+    return ctx.JSON(report)
+}
+
+func (c *BackupController) runScrubber(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        c.scrubAll()
+    }
+}
+
+// scrubAll re-verifies every finished backup. Overlapping passes are
+// skipped, a slow NAS can easily take longer than the interval.
+func (c *BackupController) scrubAll() {
+    if !c.scrubbing.TryLock() {
+        log.Printf("Scrub already running, skipping\n")
+        return
+    }
+    defer c.scrubbing.Unlock()
+
+    log.Printf("Starting backup scrub\n")
+    for _, backup := range c.listBackups() {
+        c.mu.RLock()
+        status := backup.Status
+        c.mu.RUnlock()
+
+        // Only backups that finished writing have anything to verify, one
+        // being repaired is rewritten by par2 and checked once it is done
+        if status != "completed" && status != "corrupted" {
+            continue
+        }
+
+        outcome, err := c.scrubBackup(backup)
+
+        c.mu.Lock()
+        // A repair queued while the scrub ran owns the backup now, and the
+        // files it rewrote make this outcome stale
+        if backup.Status != "completed" && backup.Status != "corrupted" {
+            status := backup.Status
+            c.mu.Unlock()
+            log.Printf("Backup %s changed to %s during its scrub, discarding the result\n", backup.ID, status)
+            continue
+        }
+        backup.LastScrubTime = time.Now()
+        backup.ScrubOutcome = outcome
+        backup.ScrubError = ""
+        if err != nil {
+            backup.ScrubError = err.Error()
+        }
+        switch outcome {
+        case "corrupted":
+            backup.Status = "corrupted"
+        case "ok":
+            backup.Status = "completed"
+        }
+        c.mu.Unlock()
+
+        log.Printf("Scrubbed backup %s: %s\n", backup.ID, outcome)
+    }
+    log.Printf("Backup scrub finished\n")
+}
+
+// scrubBackup recomputes the archive checksum against the one recorded at
+// creation and checks that the archive can still be read end to end.
+func (c *BackupController) scrubBackup(backup *models.Backup) (string, error) {
+    if backup.CompressionType == models.Snapshot {
+        return "skipped", fmt.Errorf("snapshots have no archive checksum")
+    }
+
+    if _, err := os.Stat(backup.DestinationPath); err != nil {
+        return "corrupted", err
+    }
+
+    if backup.Checksum != "" {
+        checksum, err := fileChecksum(backup.DestinationPath)
+        if err != nil {
+            return "corrupted", err
+        }
+        if checksum != backup.Checksum {
+            return "corrupted", fmt.Errorf("checksum mismatch: expected %s, got %s", backup.Checksum, checksum)
+        }
+    }
+
+    if err := testArchive(backup); err != nil {
+        return "corrupted", err
+    }
+    return "ok", nil
+}
+
+// testArchive asks the archiver to read the whole archive back
+func testArchive(backup *models.Backup) error {
+    var cmd *exec.Cmd
+    switch backup.CompressionType {
+    case models.Tar, models.TarGz, models.TarBz2, models.TarXz:
+        // tar detects the compression itself when reading
+        cmd = exec.Command("tar", "-tf", backup.DestinationPath)
+    case models.Zip:
+        cmd = exec.Command("unzip", "-tq", backup.DestinationPath)
+    case models.SevenZ:
+        cmd = exec.Command("7z", "t", backup.DestinationPath)
+    case models.Rar:
+        cmd = exec.Command("rar", "t", backup.DestinationPath)
+    default:
+        return fmt.Errorf("unsupported compression type: %s", backup.CompressionType)
+    }
+
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("archive test failed: %s. Output: %s", err, string(output))
+    }
+    return nil
+}
@@ -0,0 +1,288 @@
+package controllers
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "regexp"
+    "strconv"
+    "strings"
+    "task-automation-rig/models"
+)
+
+var audioBitratePattern = regexp.MustCompile(`^[0-9]+k?$`)
+
+// containerAudioCodecs lists the source codecs each container can carry
+// as-is. Matroska takes anything.
+var containerAudioCodecs = map[models.ContainerFormat][]string{
+    models.MP4:  {"aac", "mp3", "ac3", "eac3", "alac", "opus", "flac"},
+    models.WebM: {"opus", "vorbis"},
+    models.AVI:  {"mp3", "ac3", "pcm_s16le", "pcm_u8"},
+}
+
+// validateAudioOptions checks the audio block against the output target and
+// fills in loudnorm defaults
+func validateAudioOptions(request *models.MediaRequest) error {
+    audio := request.Audio
+    if audio == nil {
+        return nil
+    }
+
+    switch audio.Codec {
+    case "", models.AudioAAC, models.AudioOpus, models.AudioMP3, models.AudioFLAC, models.AudioCopy:
+    default:
+        return fmt.Errorf("unsupported audio codec: %s", audio.Codec)
+    }
+
+    if audio.Codec != "" && audio.Codec != models.AudioCopy {
+        if !audioCodecAllowed(request.OutputMode, request.ContainerFormat, request.Packaging, audio.Codec) {
+            return fmt.Errorf("audio codec %s is not supported in this output", audio.Codec)
+        }
+    }
+
+    if audio.Codec == models.AudioCopy {
+        if audio.Loudnorm != nil || audio.Bitrate != "" || audio.Channels != 0 || audio.SampleRate != 0 || len(audio.Filters) > 0 {
+            return fmt.Errorf("audio settings need a codec other than copy")
+        }
+        if request.OutputMode != models.OutputFiles {
+            return fmt.Errorf("audio copy is not supported in %s output", request.OutputMode)
+        }
+    }
+
+    if audio.Bitrate != "" && !audioBitratePattern.MatchString(audio.Bitrate) {
+        return fmt.Errorf("invalid audio bitrate: %s", audio.Bitrate)
+    }
+    if audio.Channels < 0 || audio.Channels > 8 {
+        return fmt.Errorf("audio channels must be between 1 and 8")
+    }
+    if audio.SampleRate < 0 || audio.SampleRate > 192000 {
+        return fmt.Errorf("invalid audio sample rate: %d", audio.SampleRate)
+    }
+
+    if norm := audio.Loudnorm; norm != nil {
+        if norm.Integrated == 0 {
+            norm.Integrated = -23
+        }
+        if norm.TruePeak == 0 {
+            norm.TruePeak = -1
+        }
+        if norm.LRA == 0 {
+            norm.LRA = 7
+        }
+        // The ranges loudnorm accepts
+        if norm.Integrated < -70 || norm.Integrated > -5 || norm.TruePeak < -9 || norm.TruePeak > 0 ||
+            norm.LRA < 1 || norm.LRA > 50 {
+            return fmt.Errorf("loudnorm targets out of range (integrated -70..-5, truePeak -9..0, lra 1..50)")
+        }
+    }
+
+    return validateAudioFilters(audio)
+}
+
+// audioCodecAllowed reports whether an encoded codec fits the output
+func audioCodecAllowed(mode models.OutputMode, format models.ContainerFormat, packaging *models.PackagingOptions, codec models.AudioCodec) bool {
+    switch mode {
+    case models.OutputHLS:
+        if packaging != nil && packaging.FMP4 {
+            return codec != models.AudioMP3
+        }
+        return codec == models.AudioAAC || codec == models.AudioMP3
+    case models.OutputDASH:
+        return codec == models.AudioAAC || codec == models.AudioOpus || codec == models.AudioFLAC
+    }
+
+    switch format {
+    case models.WebM:
+        return codec == models.AudioOpus
+    case models.AVI:
+        return codec == models.AudioMP3
+    case models.MKV:
+        return true
+    default: // MP4
+        return true
+    }
+}
+
+// resolveAudioCodec decides what to do with the source audio. An explicit
+// codec wins; otherwise audio is copied when the container takes it and
+// encoded with the container's usual codec when it does not.
+func resolveAudioCodec(job *models.MediaJob, file *models.MediaFile) models.AudioCodec {
+    if job.Audio != nil && job.Audio.Codec != "" {
+        return job.Audio.Codec
+    }
+
+    if job.OutputMode != models.OutputFiles {
+        return models.AudioAAC
+    }
+
+    fallback := models.AudioAAC
+    switch job.ContainerFormat {
+    case models.WebM:
+        fallback = models.AudioOpus
+    case models.AVI:
+        fallback = models.AudioMP3
+    }
+
+    // Any other setting means the audio is re-encoded anyway
+    if job.Audio != nil {
+        return fallback
+    }
+
+    if file.Probe == nil || job.ContainerFormat == models.MKV {
+        return models.AudioCopy
+    }
+    // Every selected track has to fit, one -c:a covers them all. Selection
+    // errors surface where the tracks are mapped.
+    tracks, _ := selectAudioTracks(job, file)
+    for _, track := range tracks {
+        fits := false
+        for _, codec := range containerAudioCodecs[job.ContainerFormat] {
+            if track.codec == codec {
+                fits = true
+            }
+        }
+        if !fits {
+            log.Printf("Source audio %s does not fit %s, encoding to %s\n", track.codec, job.ContainerFormat, fallback)
+            return fallback
+        }
+    }
+    return models.AudioCopy
+}
+
+// audioArgs builds the audio encoding arguments for one output
+func audioArgs(job *models.MediaJob, file *models.MediaFile) []string {
+    codec := resolveAudioCodec(job, file)
+    if codec == models.AudioCopy {
+        return []string{"-c:a", "copy"}
+    }
+
+    audio := job.Audio
+    if audio == nil {
+        audio = &models.AudioOptions{}
+    }
+
+    args := []string{"-c:a", getFFmpegAudioCodec(codec)}
+
+    bitrate := audio.Bitrate
+    if bitrate == "" {
+        bitrate = defaultAudioBitrate(codec)
+    }
+    if bitrate != "" {
+        args = append(args, "-b:a", bitrate)
+    }
+
+    channels := audio.Channels
+    if channels == 0 && job.OutputMode != models.OutputFiles {
+        // Adaptive players expect stereo
+        channels = 2
+    }
+    if channels > 0 {
+        args = append(args, "-ac", strconv.Itoa(channels))
+    }
+
+    // loudnorm resamples to 192 kHz internally, pin the output rate
+    sampleRate := audio.SampleRate
+    if sampleRate == 0 && (audio.Loudnorm != nil || codec == models.AudioOpus) {
+        sampleRate = 48000
+    }
+    if sampleRate > 0 {
+        args = append(args, "-ar", strconv.Itoa(sampleRate))
+    }
+
+    // The steps run first, loudnorm measured their output
+    var filters []string
+    if steps := audioStepChain(audio.Filters, file.Duration); steps != "" {
+        filters = append(filters, steps)
+    }
+    if audio.Loudnorm != nil && file.Loudness != nil {
+        filters = append(filters, loudnormFilter(audio.Loudnorm, file.Loudness))
+    }
+    if len(filters) > 0 {
+        args = append(args, "-af", strings.Join(filters, ","))
+    }
+
+    // Older muxers still flag Opus and FLAC in MP4 as experimental
+    if job.OutputMode == models.OutputFiles && job.ContainerFormat != models.MKV &&
+        job.ContainerFormat != models.WebM && (codec == models.AudioOpus || codec == models.AudioFLAC) {
+        args = append(args, "-strict", "experimental")
+    }
+
+    return args
+}
+
+func getFFmpegAudioCodec(codec models.AudioCodec) string {
+    switch codec {
+    case models.AudioOpus:
+        return "libopus"
+    case models.AudioMP3:
+        return "libmp3lame"
+    case models.AudioFLAC:
+        return "flac"
+    default:
+        return "aac"
+    }
+}
+
+func defaultAudioBitrate(codec models.AudioCodec) string {
+    switch codec {
+    case models.AudioOpus:
+        return "96k"
+    case models.AudioMP3:
+        return "192k"
+    case models.AudioFLAC:
+        return "" // Lossless
+    default:
+        return "128k"
+    }
+}
+
+// loudnormFilter is the second, linear pass fed with the first pass values
+func loudnormFilter(target *models.LoudnormOptions, measured *models.LoudnessMeasurement) string {
+    return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true",
+        target.Integrated, target.TruePeak, target.LRA,
+        measured.Integrated, measured.TruePeak, measured.LRA, measured.Threshold, measured.TargetOffset)
+}
+
+// measureLoudness runs the first loudnorm pass over the audio track stream
+// of an input, after the filters in prefilter when there are any
+func measureLoudness(input []string, stream, prefilter string, target *models.LoudnormOptions) (*models.LoudnessMeasurement, error) {
+    filter := fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:print_format=json", target.Integrated, target.TruePeak, target.LRA)
+    if prefilter != "" {
+        filter = prefilter + "," + filter
+    }
+    args := append([]string{"-hide_banner"}, input...)
+    output, err := runFFmpegOutput(append(args, "-map", stream, "-af", filter, "-f", "null", "-")...)
+    if err != nil {
+        return nil, err
+    }
+
+    // The JSON block is the last thing loudnorm prints
+    start := strings.LastIndex(output, "{")
+    end := strings.LastIndex(output, "}")
+    if start < 0 || end < start {
+        return nil, fmt.Errorf("no loudnorm measurement in ffmpeg output")
+    }
+
+    var raw map[string]string
+    if err := json.Unmarshal([]byte(output[start:end+1]), &raw); err != nil {
+        return nil, fmt.Errorf("unreadable loudnorm measurement: %v", err)
+    }
+
+    measured := &models.LoudnessMeasurement{
+        Integrated:   parseFloat(raw["input_i"]),
+        TruePeak:     parseFloat(raw["input_tp"]),
+        LRA:          parseFloat(raw["input_lra"]),
+        Threshold:    parseFloat(raw["input_thresh"]),
+        TargetOffset: parseFloat(raw["target_offset"]),
+    }
+
+    // Digital silence measures as -inf, there is nothing to normalise
+    for _, value := range []float64{measured.Integrated, measured.TruePeak, measured.Threshold, measured.TargetOffset} {
+        if math.IsInf(value, 0) || math.IsNaN(value) {
+            log.Printf("Audio of %s is silent, skipping loudness normalisation\n", input[len(input)-1])
+            return nil, nil
+        }
+    }
+    return measured, nil
+}
@@ -0,0 +1,302 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "task-automation-rig/models"
+)
+
+// encodeChunk is one stretch of a file encoded on its own
+type encodeChunk struct {
+    start float64 // Seconds into the file
+    end   float64
+}
+
+// validateChunkOptions checks the chunking block and fills in its defaults
+func validateChunkOptions(request *models.MediaRequest) error {
+    opts := request.Chunking
+    if opts == nil {
+        return nil
+    }
+
+    switch opts.SplitAt {
+    case "":
+        opts.SplitAt = "keyframes"
+    case "keyframes", "scenes":
+    default:
+        return fmt.Errorf("unsupported chunk split: %s", opts.SplitAt)
+    }
+    if opts.ChunkDuration == 0 {
+        opts.ChunkDuration = 60
+    }
+    if opts.Parallel == 0 {
+        opts.Parallel = runtime.NumCPU() / 2
+        if opts.Parallel < 1 {
+            opts.Parallel = 1
+        }
+    }
+    if opts.Retries == 0 {
+        opts.Retries = 2
+    }
+
+    if opts.ChunkDuration < 10 || opts.ChunkDuration > 600 {
+        return fmt.Errorf("chunk duration must be between 10 and 600 seconds")
+    }
+    if opts.Parallel < 1 || opts.Parallel > 64 || opts.Retries < 0 || opts.Retries > 5 {
+        return fmt.Errorf("chunk parallelism must be 1 to 64 and retries 0 to 5")
+    }
+
+    // Chunks are joined into one file and every chunk would need its own
+    // pass statistics
+    if request.OutputMode != models.OutputFiles {
+        return fmt.Errorf("chunked encoding needs files output")
+    }
+    if request.RateControl != nil && request.RateControl.Mode == models.RateTargetSize {
+        return fmt.Errorf("chunked encoding does not support targetSize rate control")
+    }
+    // Chunks are cut and verified on the source timeline, which a speed
+    // change would stretch under them
+    if request.Filters != nil && request.Filters.Speed != 0 && request.Filters.Speed != 1.0 {
+        return fmt.Errorf("chunked encoding does not support a speed filter")
+    }
+    return nil
+}
+
+// planChunks splits a file at keyframes or scene cuts into chunks of at
+// least the chunk duration
+func planChunks(job *models.MediaJob, file *models.MediaFile) ([]encodeChunk, error) {
+    if file.Duration <= 0 {
+        return nil, fmt.Errorf("chunked encoding needs a known duration")
+    }
+
+    var cuts []float64
+    var err error
+    if job.Chunking.SplitAt == "scenes" {
+        if file.Scenes != nil {
+            for _, scene := range file.Scenes {
+                cuts = append(cuts, scene.Start)
+            }
+        } else {
+            cuts, err = findSceneCuts(file, 0.4)
+        }
+    } else {
+        cuts, err = keyframeTimes(file)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var chunks []encodeChunk
+    start := 0.0
+    for _, cut := range cuts {
+        // The last chunk must not end up shorter than the others
+        if cut-start >= job.Chunking.ChunkDuration && file.Duration-cut >= job.Chunking.ChunkDuration/2 {
+            chunks = append(chunks, encodeChunk{start, cut})
+            start = cut
+        }
+    }
+    chunks = append(chunks, encodeChunk{start, file.Duration})
+    log.Printf("Split %s into %d chunks\n", file.Path, len(chunks))
+    return chunks, nil
+}
+
+// keyframeTimes lists the keyframes of a file's video from the packet
+// flags, which needs no decoding
+func keyframeTimes(file *models.MediaFile) ([]float64, error) {
+    stream := "v:0"
+    if file.Probe != nil {
+        if video := file.Probe.VideoStream(); video != nil {
+            stream = strconv.Itoa(video.Index)
+        }
+    }
+    args := []string{"-v", "error", "-select_streams", stream,
+        "-show_entries", "packet=pts_time,flags", "-of", "csv=p=0"}
+    if file.Clip != nil {
+        args = append(args, "-read_intervals", fmt.Sprintf("%s%%%s", formatSeconds(file.Clip.Start), formatSeconds(file.Clip.End)))
+    }
+
+    output, err := exec.Command("ffprobe", append(args, file.Path)...).Output()
+    if err != nil {
+        return nil, fmt.Errorf("failed to list keyframes: %v", err)
+    }
+
+    var times []float64
+    for _, line := range strings.Split(string(output), "\n") {
+        fields := strings.Split(strings.TrimSpace(line), ",")
+        if len(fields) < 2 || !strings.Contains(fields[1], "K") {
+            continue
+        }
+        t, err := strconv.ParseFloat(fields[0], 64)
+        if err != nil {
+            continue
+        }
+        if t -= clipOffset(file); t > 0 && t < file.Duration {
+            times = append(times, t)
+        }
+    }
+    return times, nil
+}
+
+// encodeChunked encodes the video of a rendition chunk by chunk, joins the
+// chunks with the concat demuxer and muxes the source audio and subtitles
+// back in. Failed chunks are retried on their own.
+func (c *MediaController) encodeChunked(job *models.MediaJob, file *models.MediaFile, rendition *models.RenditionOutput, rate videoRate, chunks []encodeChunk) error {
+    log.Printf("Processing resolution %s (%dx%d) in %d chunks\n", rendition.Resolution, rendition.Width, rendition.Height, len(chunks))
+
+    workDir, err := os.MkdirTemp("", "chunks-"+job.ID+"-")
+    if err != nil {
+        return fmt.Errorf("failed to create chunk directory: %v", err)
+    }
+    defer os.RemoveAll(workDir)
+
+    plan, err := renditionScale(job, file, rendition.Resolution)
+    if err != nil {
+        return err
+    }
+
+    // Chunk progress adds up to the rendition's
+    var mu sync.Mutex
+    chunkProgress := make([]ffmpegProgress, len(chunks))
+    report := func(i int, p ffmpegProgress) {
+        mu.Lock()
+        defer mu.Unlock()
+        chunkProgress[i] = p
+        var total ffmpegProgress
+        for _, cp := range chunkProgress {
+            total.Frame += cp.Frame
+            total.FPS += cp.FPS
+            total.TotalSize += cp.TotalSize
+            total.OutTime += cp.OutTime
+            total.Speed += cp.Speed
+        }
+        if total.OutTime > 0 {
+            total.BitrateKbps = float64(total.TotalSize) * 8 / 1000 / total.OutTime
+        }
+        updateRenditionProgress(job, file, rendition, total)
+    }
+
+    paths := make([]string, len(chunks))
+    errs := make([]error, len(chunks))
+    sem := make(chan struct{}, job.Chunking.Parallel)
+    var wg sync.WaitGroup
+    for i, chunk := range chunks {
+        paths[i] = filepath.Join(workDir, fmt.Sprintf("chunk_%05d.mkv", i))
+        wg.Add(1)
+        go func(i int, chunk encodeChunk) {
+            defer wg.Done()
+            sem <- struct{}{}
+            defer func() { <-sem }()
+
+            for attempt := 0; attempt <= job.Chunking.Retries; attempt++ {
+                if attempt > 0 {
+                    log.Printf("Retrying chunk %d of %s (attempt %d): %v\n", i, file.Path, attempt+1, errs[i])
+                    os.Remove(paths[i])
+                }
+                errs[i] = encodeChunkVideo(job, file, plan, rate, chunk, paths[i], func(p ffmpegProgress) {
+                    p.Done = false
+                    report(i, p)
+                })
+                if errs[i] == nil {
+                    return
+                }
+            }
+        }(i, chunk)
+    }
+    wg.Wait()
+
+    for i, err := range errs {
+        if err != nil {
+            return fmt.Errorf("chunk %d failed after %d attempts: %v", i, job.Chunking.Retries+1, err)
+        }
+    }
+
+    if err := joinChunks(job, file, rendition, paths, workDir); err != nil {
+        return err
+    }
+    return verifyDuration(rendition.OutputPath, file.Duration)
+}
+
+// encodeChunkVideo encodes the video of one chunk into a Matroska file
+func encodeChunkVideo(job *models.MediaJob, file *models.MediaFile, plan scalePlan, rate videoRate, chunk encodeChunk, output string, onProgress func(ffmpegProgress)) error {
+    input := encodeInput{
+        args: []string{
+            "-ss", formatSeconds(clipOffset(file) + chunk.start),
+            "-t", formatSeconds(chunk.end - chunk.start),
+            "-i", file.Path,
+        },
+        offset: chunk.start,
+    }
+    args, err := videoArgs(job, file, plan, rate, input, nil)
+    if err != nil {
+        return err
+    }
+    args = append(args, "-an", "-sn", "-progress", "pipe:1", "-f", "matroska", output)
+    return runFFmpeg(args, onProgress)
+}
+
+// joinChunks concatenates the chunk videos without re-encoding and muxes
+// them with the source's audio, subtitles and chapters
+func joinChunks(job *models.MediaJob, file *models.MediaFile, rendition *models.RenditionOutput, paths []string, workDir string) error {
+    var list strings.Builder
+    for _, path := range paths {
+        list.WriteString("file '" + strings.ReplaceAll(path, "'", `'\''`) + "'\n")
+    }
+    listPath := filepath.Join(workDir, "chunks.txt")
+    if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+        return fmt.Errorf("failed to write chunk list: %v", err)
+    }
+
+    chapters, err := chapterFile(job, file, workDir)
+    if err != nil {
+        return err
+    }
+
+    tracks, err := selectAudioTracks(job, file)
+    if err != nil {
+        return err
+    }
+
+    // The source stays input 0 so audio and subtitle maps point at it
+    args := inputArgs(file)
+    args = append(args, "-f", "concat", "-safe", "0", "-i", listPath)
+    if chapters != "" {
+        args = append(args, "-f", "ffmetadata", "-i", chapters)
+    }
+    args = append(args, "-map", "1:v:0", "-c:v", "copy")
+    args = append(args, containerArgs(job.ContainerFormat)...)
+    args = append(args, audioMapArgs(job, tracks)...)
+    args = append(args, audioArgs(job, file)...)
+    args = append(args, subtitleArgs(job, file)...)
+    if chapters != "" {
+        args = append(args, "-map_chapters", "2")
+    }
+    args = append(args, rendition.OutputPath)
+
+    if _, err := runFFmpegOutput(args...); err != nil {
+        return fmt.Errorf("failed to join chunks: %v", err)
+    }
+    return nil
+}
+
+// verifyDuration checks that a joined output is as long as its source, a
+// lost or doubled chunk shows up here
+func verifyDuration(output string, expected float64) error {
+    probe, err := probeMedia(output)
+    if err != nil {
+        return fmt.Errorf("cannot verify %s: %v", output, err)
+    }
+    // Half a second of slack plus 0.5% for container rounding
+    tolerance := 0.5 + expected*0.005
+    if math.Abs(probe.Duration-expected) > tolerance {
+        return fmt.Errorf("%s lasts %.2f seconds, expected %.2f", output, probe.Duration, expected)
+    }
+    return nil
+}
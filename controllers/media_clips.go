@@ -0,0 +1,283 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "task-automation-rig/models"
+)
+
+// parseTimestamp reads seconds ("90.5") or [HH:]MM:SS[.mmm] ("1:30.5")
+func parseTimestamp(value string) (float64, error) {
+    value = strings.TrimSpace(value)
+    parts := strings.Split(value, ":")
+    if value == "" || len(parts) > 3 {
+        return 0, fmt.Errorf("invalid timestamp %q", value)
+    }
+
+    var seconds float64
+    for i, part := range parts {
+        n, err := strconv.ParseFloat(part, 64)
+        if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+            return 0, fmt.Errorf("invalid timestamp %q", value)
+        }
+        // Minutes and seconds fields stay below 60
+        if i > 0 && n >= 60 {
+            return 0, fmt.Errorf("invalid timestamp %q", value)
+        }
+        seconds = seconds*60 + n
+    }
+    return seconds, nil
+}
+
+// validateClips checks the clip list against the output mode
+func validateClips(request *models.MediaRequest) error {
+    if len(request.Clips) > 100 {
+        return fmt.Errorf("at most 100 clips per job")
+    }
+    for i, clip := range request.Clips {
+        start, err := parseTimestamp(clip.Start)
+        if err != nil {
+            return fmt.Errorf("clip %d: %v", i+1, err)
+        }
+        end, err := parseTimestamp(clip.End)
+        if err != nil {
+            return fmt.Errorf("clip %d: %v", i+1, err)
+        }
+        if end <= start {
+            return fmt.Errorf("clip %d ends before it starts", i+1)
+        }
+        // Adaptive packages are always encoded
+        if !clip.Accurate && request.OutputMode != models.OutputFiles {
+            return fmt.Errorf("clip %d: %s output needs accurate clips", i+1, request.OutputMode)
+        }
+    }
+    return nil
+}
+
+// clipRanges resolves the job's clips against a source, clamping the end to
+// the probed duration
+func clipRanges(job *models.MediaJob, duration float64) ([]*models.ClipRange, error) {
+    var ranges []*models.ClipRange
+    for i, clip := range job.Clips {
+        start, _ := parseTimestamp(clip.Start)
+        end, _ := parseTimestamp(clip.End)
+        if duration > 0 {
+            if start >= duration {
+                return nil, fmt.Errorf("clip %d starts after the end of the source", i+1)
+            }
+            end = math.Min(end, duration)
+        }
+        ranges = append(ranges, &models.ClipRange{Index: i + 1, Start: start, End: end, Accurate: clip.Accurate})
+    }
+    return ranges, nil
+}
+
+// inputArgs opens a file's source, seeking to its clip. Seeking ahead of -i
+// is fast and, since ffmpeg 2.1, frame-accurate whenever the video is
+// re-encoded.
+func inputArgs(file *models.MediaFile) []string {
+    if file.Clip == nil {
+        return []string{"-i", file.Path}
+    }
+    return []string{
+        "-ss", formatSeconds(file.Clip.Start),
+        "-t", formatSeconds(file.Clip.End - file.Clip.Start),
+        "-i", file.Path,
+    }
+}
+
+// clipOffset is where a file's timeline starts in its source
+func clipOffset(file *models.MediaFile) float64 {
+    if file.Clip == nil {
+        return 0
+    }
+    return file.Clip.Start
+}
+
+// copyExtension is the extension of a stream copy of a source, which keeps
+// its container. ffmpeg picks the muxer by extension, so sources without
+// one, such as camera files, take it from the probed format, and Matroska
+// holds whatever the probe could not name.
+func copyExtension(path string, probe *models.ProbeResult) string {
+    if ext := filepath.Ext(path); ext != "" {
+        return ext
+    }
+    if probe != nil {
+        // ffprobe lists every name of the demuxer, the first is enough
+        format, _, _ := strings.Cut(probe.Container, ",")
+        switch format {
+        case "mov":
+            return ".mov"
+        case "mpegts":
+            return ".ts"
+        case "mpeg":
+            return ".mpg"
+        case "avi":
+            return ".avi"
+        case "flv":
+            return ".flv"
+        case "asf":
+            return ".wmv"
+        }
+    }
+    return ".mkv"
+}
+
+// copyClip cuts a fast clip without re-encoding. The cut snaps back to the
+// keyframe before the start, and the source container is kept so every
+// stream fits.
+func (c *MediaController) copyClip(job *models.MediaJob, file *models.MediaFile) error {
+    rendition := file.Renditions[0]
+    setRenditionStatus(job, rendition, "in_progress")
+
+    maps, err := copyMapArgs(job, file)
+    if err != nil {
+        setRenditionStatus(job, rendition, "failed")
+        return err
+    }
+    args := append(inputArgs(file), maps...)
+    args = append(args, "-c", "copy", "-avoid_negative_ts", "make_zero",
+        "-progress", "pipe:1", rendition.OutputPath)
+    err = runFFmpeg(args, func(p ffmpegProgress) {
+        updateRenditionProgress(job, file, rendition, p)
+    })
+    if err != nil {
+        setRenditionStatus(job, rendition, "failed")
+        return err
+    }
+
+    setRenditionStatus(job, rendition, "completed")
+    log.Printf("Completed clip %d of %s\n", file.Clip.Index, file.Path)
+    return nil
+}
+
+// joinSources concatenates the job's concat list into one mezzanine file in
+// workDir. Sources with identical streams are joined by the concat demuxer
+// without re-encoding; anything else is normalised to the first source's
+// size and frame rate and joined by the concat filter.
+func joinSources(sources []string, workDir string) (string, error) {
+    probes := make([]*models.ProbeResult, len(sources))
+    for i, source := range sources {
+        probe, err := probeMedia(source)
+        if err != nil {
+            return "", fmt.Errorf("cannot join %s: %v", source, err)
+        }
+        if probe.VideoStream() == nil {
+            return "", fmt.Errorf("cannot join %s: no video stream", source)
+        }
+        probes[i] = probe
+    }
+
+    output := filepath.Join(workDir, "concat.mkv")
+    if sourcesMatch(probes) {
+        log.Printf("Joining %d sources without re-encoding\n", len(sources))
+        return output, concatDemuxer(sources, workDir, output)
+    }
+
+    log.Printf("Sources differ, normalising %d sources before joining\n", len(sources))
+    return output, concatFilter(sources, probes, output)
+}
+
+// sourcesMatch reports whether the first video and audio streams of every
+// source share the parameters the concat demuxer needs to stay in sync
+func sourcesMatch(probes []*models.ProbeResult) bool {
+    first := probes[0]
+    video := first.VideoStream()
+    audio := first.StreamsOfType("audio")
+    for _, probe := range probes[1:] {
+        v := probe.VideoStream()
+        if v.Codec != video.Codec || v.Profile != video.Profile || v.Width != video.Width ||
+            v.Height != video.Height || v.PixelFormat != video.PixelFormat ||
+            v.FrameRate != video.FrameRate || v.Rotation != video.Rotation {
+            return false
+        }
+        a := probe.StreamsOfType("audio")
+        if len(a) != len(audio) {
+            return false
+        }
+        if len(a) > 0 && (a[0].Codec != audio[0].Codec || a[0].SampleRate != audio[0].SampleRate ||
+            a[0].Channels != audio[0].Channels) {
+            return false
+        }
+    }
+    return true
+}
+
+func concatDemuxer(sources []string, workDir, output string) error {
+    var list strings.Builder
+    for _, source := range sources {
+        // Single quotes end the quoted path, escape them the shell way
+        list.WriteString("file '" + strings.ReplaceAll(source, "'", `'\''`) + "'\n")
+    }
+    listPath := filepath.Join(workDir, "concat.txt")
+    if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+        return fmt.Errorf("failed to write concat list: %v", err)
+    }
+
+    _, err := runFFmpegOutput("-f", "concat", "-safe", "0", "-i", listPath,
+        "-map", "0:v:0", "-map", "0:a:0?", "-c", "copy", output)
+    return err
+}
+
+// concatFilter re-encodes every source to a common format on the way into
+// the concat filter. The mezzanine is near-lossless so the real encode that
+// follows is not working from a degraded copy.
+func concatFilter(sources []string, probes []*models.ProbeResult, output string) error {
+    width, height := displaySize(probes[0].VideoStream())
+    width, height = evenRound(float64(width)), evenRound(float64(height))
+    frameRate := probes[0].VideoStream().FrameRate
+    if frameRate <= 0 {
+        frameRate = 30
+    }
+
+    hasAudio := false
+    for _, probe := range probes {
+        if len(probe.StreamsOfType("audio")) > 0 {
+            hasAudio = true
+        }
+    }
+
+    var args []string
+    var graph, inputs strings.Builder
+    for i, source := range sources {
+        args = append(args, "-i", source)
+        graph.WriteString(fmt.Sprintf(
+            "[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%g,format=yuv420p[v%d];",
+            i, width, height, width, height, frameRate, i))
+        inputs.WriteString(fmt.Sprintf("[v%d]", i))
+
+        if !hasAudio {
+            continue
+        }
+        if len(probes[i].StreamsOfType("audio")) > 0 {
+            graph.WriteString(fmt.Sprintf("[%d:a:0]aformat=sample_rates=48000:channel_layouts=stereo[a%d];", i, i))
+        } else {
+            // Silence keeps the audio of the following sources in place
+            graph.WriteString(fmt.Sprintf("anullsrc=r=48000:cl=stereo,atrim=duration=%.3f[a%d];", probes[i].Duration, i))
+        }
+        inputs.WriteString(fmt.Sprintf("[a%d]", i))
+    }
+
+    audioOutputs := 0
+    if hasAudio {
+        audioOutputs = 1
+    }
+    graph.WriteString(fmt.Sprintf("%sconcat=n=%d:v=1:a=%d[vout]", inputs.String(), len(sources), audioOutputs))
+    if hasAudio {
+        graph.WriteString("[aout]")
+    }
+
+    args = append(args, "-filter_complex", graph.String(), "-map", "[vout]")
+    if hasAudio {
+        args = append(args, "-map", "[aout]", "-c:a", "flac")
+    }
+    args = append(args, "-c:v", "libx264", "-crf", "16", "-preset", "veryfast", output)
+
+    _, err := runFFmpegOutput(args...)
+    return err
+}
@@ -1,26 +1,37 @@
 package controllers
 
 import (
+    "encoding/json"
     "fmt"
     "os"
     "path/filepath"
+    "strconv"
     "strings"
+    "sync"
     "time"
-    "os/exec"
     "log"
-    "bufio"
     "github.com/gofiber/fiber/v2"
     "github.com/google/uuid"
+    "task-automation-rig/config"
     "task-automation-rig/models"
 )
 
 type MediaController struct {
-    jobs map[string]*models.MediaJob
+    config    *config.Config
+    sandbox   *pathSandbox
+    scheduler *Scheduler
+    presets   *presetStore
+    mu        sync.RWMutex
+    jobs      map[string]*models.MediaJob
 }
 
-func NewMediaController() *MediaController {
+func NewMediaController(cfg *config.Config, scheduler *Scheduler) *MediaController {
     return &MediaController{
-        jobs: make(map[string]*models.MediaJob),
+        config:    cfg,
+        sandbox:   newPathSandbox(cfg.AllowedSourceRoots, cfg.AllowedDestinationRoots),
+        scheduler: scheduler,
+        presets:   newPresetStore(cfg.MediaPresetsFile),
+        jobs:      make(map[string]*models.MediaJob),
     }
 }
 
@@ -32,101 +43,503 @@ func (c *MediaController) CreateMediaJob(ctx *fiber.Ctx) error {
         })
     }
 
-    if request.SourcePath == "" || request.DestinationPath == "" {
+    // A preset supplies the starting values, the fields of the request
+    // override them one by one
+    if request.Preset != "" {
+        preset, exists := c.presets.get(request.Preset)
+        if !exists {
+            return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+                "error": fmt.Sprintf("Unknown preset: %s", request.Preset),
+            })
+        }
+        settings, err := presetSettings(preset)
+        if err != nil {
+            return err
+        }
+        if err := ctx.BodyParser(&settings); err != nil {
+            return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+                "error": "Invalid request body",
+            })
+        }
+        request = settings
+    }
+
+    if (request.SourcePath == "") == (len(request.Concat) == 0) || request.DestinationPath == "" {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "A destination path and either a source path or a concat list are required",
+        })
+    }
+    if len(request.Concat) == 1 || len(request.Concat) > 100 {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "A concat list needs between 2 and 100 sources",
+        })
+    }
+
+    // Confine reads and writes to the configured roots
+    if request.SourcePath != "" {
+        sourcePath, err := c.sandbox.checkSource(request.SourcePath)
+        if err != nil {
+            return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+                "error": err.Error(),
+            })
+        }
+        request.SourcePath = sourcePath
+    }
+    for i, source := range request.Concat {
+        sourcePath, err := c.sandbox.checkSource(source)
+        if err != nil {
+            return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+                "error": err.Error(),
+            })
+        }
+        request.Concat[i] = sourcePath
+    }
+    destinationPath, err := c.sandbox.checkDestination(request.DestinationPath)
+    if err != nil {
+        return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    }
+    request.DestinationPath = destinationPath
+    if request.Filters != nil {
+        for i := range request.Filters.Watermarks {
+            wm := &request.Filters.Watermarks[i]
+            for _, path := range []*string{&wm.Image, &wm.FontFile} {
+                if *path == "" {
+                    continue
+                }
+                resolved, err := c.sandbox.checkSource(*path)
+                if err != nil {
+                    return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+                        "error": err.Error(),
+                    })
+                }
+                *path = resolved
+            }
+        }
+        for i := range request.Filters.Steps {
+            step := &request.Filters.Steps[i]
+            if step.File == "" {
+                continue
+            }
+            resolved, err := c.sandbox.checkSource(step.File)
+            if err != nil {
+                return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+                    "error": err.Error(),
+                })
+            }
+            step.File = resolved
+        }
+    }
+    if request.Subtitles != nil && request.Subtitles.BurnFile != "" {
+        burnFile, err := c.sandbox.checkSource(request.Subtitles.BurnFile)
+        if err != nil {
+            return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+                "error": err.Error(),
+            })
+        }
+        request.Subtitles.BurnFile = burnFile
+    }
+
+    if err := validateMediaRequest(&request); err != nil {
         return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-            "error": "Source and destination paths are required",
+            "error": err.Error(),
         })
     }
 
     job := &models.MediaJob{
         ID:              uuid.New().String(),
+        Preset:          request.Preset,
         SourcePath:      request.SourcePath,
         CodecType:       request.CodecType,
         ContainerFormat: request.ContainerFormat,
         Resolutions:     request.Resolutions,
         DestinationPath: request.DestinationPath,
         Filters:         request.Filters,
-        Status:         "pending",
+        OutputMode:      request.OutputMode,
+        Packaging:       request.Packaging,
+        Thumbnails:      request.Thumbnails,
+        Audio:           request.Audio,
+        RateControl:     request.RateControl,
+        ScaleMode:       request.ScaleMode,
+        Subtitles:       request.Subtitles,
+        Clips:           request.Clips,
+        Concat:          request.Concat,
+        Scenes:          request.Scenes,
+        Quality:         request.Quality,
+        Ladder:          request.Ladder,
+        Chunking:        request.Chunking,
+        Parallelism:     request.Parallelism,
+        ContinueOnError: request.ContinueOnError,
+        Include:         request.Include,
+        Exclude:         request.Exclude,
+        Streams:         request.Streams,
+        Status:         "queued",
         ProcessedFiles:  make([]string, 0),
+        Files:           make([]*models.MediaFile, 0),
         StartTime:      time.Now(),
     }
 
+    c.mu.Lock()
     c.jobs[job.ID] = job
-    go c.processMediaJob(job)
+    c.mu.Unlock()
+
+    // Run the job once a worker is free
+    c.scheduler.submit(mediaJobs, job.ID, func() { c.processMediaJob(job) })
+
+    job.Lock()
+    defer job.Unlock()
+    return ctx.Status(fiber.StatusAccepted).JSON(c.jobView(job))
+}
+
+// validateMediaRequest checks option combinations and fills in defaults
+func validateMediaRequest(request *models.MediaRequest) error {
+    switch request.OutputMode {
+    case "":
+        request.OutputMode = models.OutputFiles
+    case models.OutputFiles, models.OutputHLS, models.OutputDASH:
+    default:
+        return fmt.Errorf("unsupported output mode: %s", request.OutputMode)
+    }
+
+    if err := validateLadderOptions(request); err != nil {
+        return err
+    }
+
+    for _, resolution := range request.Resolutions {
+        if _, _, err := resolution.Dimensions(); err != nil {
+            return err
+        }
+    }
+
+    switch request.ScaleMode {
+    case "":
+        request.ScaleMode = models.ScaleFit
+    case models.ScaleFit, models.ScaleFill, models.ScalePad:
+    default:
+        return fmt.Errorf("unsupported scale mode: %s", request.ScaleMode)
+    }
+
+    if request.OutputMode != models.OutputFiles {
+        if len(request.Resolutions) == 0 {
+            return fmt.Errorf("%s output needs at least one resolution", request.OutputMode)
+        }
+        if request.Packaging == nil {
+            request.Packaging = &models.PackagingOptions{}
+        }
+        if request.Packaging.SegmentDuration == 0 {
+            request.Packaging.SegmentDuration = 6
+        }
+        if request.Packaging.SegmentDuration < 1 || request.Packaging.SegmentDuration > 60 {
+            return fmt.Errorf("segment duration must be between 1 and 60 seconds")
+        }
+        // MPEG-TS segments can only carry H.264 and H.265
+        if request.OutputMode == models.OutputHLS && !request.Packaging.FMP4 &&
+            (request.CodecType == models.VP9 || request.CodecType == models.AV1) {
+            return fmt.Errorf("%s in HLS requires fmp4 segments", request.CodecType)
+        }
+    }
+
+    if err := validateAudioOptions(request); err != nil {
+        return err
+    }
+
+    if err := validateRateControl(request); err != nil {
+        return err
+    }
+
+    if err := validateWatermarks(request.Filters); err != nil {
+        return err
+    }
+
+    if err := validateFilterSteps(request.Filters); err != nil {
+        return err
+    }
+
+    if err := validateSubtitleOptions(request); err != nil {
+        return err
+    }
+
+    if err := validateClips(request); err != nil {
+        return err
+    }
+
+    if err := validateSceneOptions(request); err != nil {
+        return err
+    }
+
+    if err := validateQualityOptions(request); err != nil {
+        return err
+    }
+
+    if err := validateChunkOptions(request); err != nil {
+        return err
+    }
+
+    if err := validatePatterns(request); err != nil {
+        return err
+    }
+
+    if err := validateStreamOptions(request); err != nil {
+        return err
+    }
+
+    if request.Parallelism == 0 {
+        request.Parallelism = 1
+    }
+    if request.Parallelism < 1 || request.Parallelism > 16 {
+        return fmt.Errorf("parallelism must be between 1 and 16 files")
+    }
+
+    if thumbs := request.Thumbnails; thumbs != nil {
+        switch thumbs.PosterMode {
+        case "":
+            thumbs.PosterMode = "offset"
+        case "offset", "scene":
+        default:
+            return fmt.Errorf("unsupported poster mode: %s", thumbs.PosterMode)
+        }
+        if thumbs.SceneThreshold == 0 {
+            thumbs.SceneThreshold = 0.4
+        }
+        if thumbs.Width == 0 {
+            thumbs.Width = 320
+        }
+        if thumbs.SpriteInterval == 0 {
+            thumbs.SpriteInterval = 10
+        }
+        if thumbs.SpriteColumns == 0 {
+            thumbs.SpriteColumns = 10
+        }
+        if thumbs.PosterOffset < 0 || thumbs.SceneThreshold < 0 || thumbs.SceneThreshold > 1 {
+            return fmt.Errorf("poster offset must be positive and scene threshold between 0 and 1")
+        }
+        if thumbs.Count < 0 || thumbs.Count > 100 {
+            return fmt.Errorf("thumbnail count must be between 0 and 100")
+        }
+        if thumbs.Width < 16 || thumbs.Width > maxThumbnailWidth || thumbs.Width%2 != 0 {
+            return fmt.Errorf("thumbnail width must be even and between 16 and %d", maxThumbnailWidth)
+        }
+        if thumbs.SpriteInterval < minSpriteInterval || thumbs.SpriteColumns < 1 || thumbs.SpriteColumns > 100 {
+            return fmt.Errorf("sprite interval must be at least %g seconds and columns between 1 and 100", minSpriteInterval)
+        }
+    }
 
-    return ctx.Status(fiber.StatusAccepted).JSON(job)
+    return nil
 }
 
 func (c *MediaController) GetMediaJob(ctx *fiber.Ctx) error {
     id := ctx.Params("id")
+    c.mu.RLock()
     job, exists := c.jobs[id]
+    c.mu.RUnlock()
     if !exists {
         return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
             "error": "Job not found",
         })
     }
-    return ctx.JSON(job)
+    job.Lock()
+    defer job.Unlock()
+    return ctx.JSON(c.jobView(job))
 }
 
 func (c *MediaController) ListMediaJobs(ctx *fiber.Ctx) error {
-    jobList := make([]*models.MediaJob, 0, len(c.jobs))
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+
+    // Each job is serialized under its own lock, holding them all at once
+    // could deadlock two listings
+    jobList := make([]json.RawMessage, 0, len(c.jobs))
     for _, job := range c.jobs {
-        jobList = append(jobList, job)
+        job.Lock()
+        data, err := json.Marshal(c.jobView(job))
+        job.Unlock()
+        if err != nil {
+            return err
+        }
+        jobList = append(jobList, data)
     }
     return ctx.JSON(jobList)
 }
 
+// mediaJobView is a job as the API returns it. The queue position is
+// looked up per response, jobs shared with the workers are never written;
+// callers hold the job lock while the view is serialized.
+type mediaJobView struct {
+    *models.MediaJob
+    QueuePosition int `json:"queuePosition,omitempty"` // Place in the media queue while queued
+}
+
+func (c *MediaController) jobView(job *models.MediaJob) mediaJobView {
+    return mediaJobView{MediaJob: job, QueuePosition: c.scheduler.position(mediaJobs, job.ID)}
+}
+
 func (c *MediaController) processMediaJob(job *models.MediaJob) {
+    job.Lock()
     job.Status = "in_progress"
+    job.Unlock()
     log.Printf("Starting media job: %s\n", job.ID)
     
     if err := os.MkdirAll(job.DestinationPath, 0755); err != nil {
         log.Printf("Failed to create destination directory: %v\n", err)
+        job.Lock()
         job.Status = "failed"
         job.Error = fmt.Sprintf("Failed to create destination directory: %v", err)
         job.EndTime = time.Now()
+        job.Unlock()
         return
     }
 
-    fileInfo, err := os.Stat(job.SourcePath)
-    if err != nil {
-        log.Printf("Failed to access source path: %v\n", err)
+    // A retry re-runs the files an earlier run laid out. When that run
+    // stopped before every source was laid out nothing was processed yet,
+    // so it starts over from the walk.
+    retry := job.LaidOut
+    if !retry {
+        job.Lock()
+        job.Files = nil
+        job.Skipped = nil
+        job.Unlock()
+    }
+
+    var sources []string
+    var err error
+    if len(job.Concat) > 0 {
+        // The joined mezzanine only lives as long as the job
+        var workDir, joined string
+        workDir, err = os.MkdirTemp("", "concat-"+job.ID+"-")
+        if err == nil {
+            defer os.RemoveAll(workDir)
+            joined, err = joinSources(job.Concat, workDir)
+            sources = append(sources, joined)
+        }
+    } else if retry {
+        // A retry re-runs the files laid out by the first run
+        log.Printf("Retrying failed items of job %s\n", job.ID)
+    } else if fileInfo, statErr := os.Stat(job.SourcePath); statErr != nil {
+        log.Printf("Failed to access source path: %v\n", statErr)
+        job.Lock()
         job.Status = "failed"
-        job.Error = fmt.Sprintf("Failed to access source path: %v", err)
+        job.Error = fmt.Sprintf("Failed to access source path: %v", statErr)
         job.EndTime = time.Now()
+        job.Unlock()
         return
-    }
-
-    if fileInfo.IsDir() {
+    } else if fileInfo.IsDir() {
         log.Printf("Processing directory: %s\n", job.SourcePath)
         err = filepath.Walk(job.SourcePath, func(path string, info os.FileInfo, err error) error {
             if err != nil {
-                return err
-            }
-            if !info.IsDir() && isVideoFile(path) {
-                log.Printf("Found video file: %s\n", path)
-                if err := c.processVideo(job, path); err != nil {
-                    log.Printf("Error processing video %s: %v\n", path, err)
+                if !job.ContinueOnError {
                     return err
                 }
-                job.ProcessedFiles = append(job.ProcessedFiles, path)
+                // Unreadable entries are recorded and the walk goes on
+                log.Printf("Skipping %s: %v\n", path, err)
+                job.Lock()
+                job.Files = append(job.Files, failedMediaFile(path, err))
+                job.Unlock()
+                return nil
             }
+            if path == job.SourcePath {
+                return nil
+            }
+
+            rel, _ := filepath.Rel(job.SourcePath, path)
+            if reason := excludedBy(job, rel, info.IsDir()); reason != "" {
+                skipFile(job, path, reason)
+                if info.IsDir() {
+                    return filepath.SkipDir
+                }
+                return nil
+            }
+            if info.IsDir() {
+                return nil
+            }
+            if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+                skipFile(job, path, "not a regular file")
+                return nil
+            }
+
+            // A symlink inside the source tree may point anywhere
+            if info.Mode()&os.ModeSymlink != 0 {
+                resolved, err := c.sandbox.checkSource(path)
+                if err != nil {
+                    skipFile(job, path, err.Error())
+                    return nil
+                }
+                path = resolved
+            }
+            if err := detectVideo(path); err != nil {
+                skipFile(job, path, err.Error())
+                return nil
+            }
+            log.Printf("Found video file: %s\n", path)
+            sources = append(sources, path)
             return nil
         })
     } else {
         log.Printf("Processing single file: %s\n", job.SourcePath)
-        if isVideoFile(job.SourcePath) {
-            err = c.processVideo(job, job.SourcePath)
-            if err == nil {
-                job.ProcessedFiles = append(job.ProcessedFiles, job.SourcePath)
-            }
+        if detectErr := detectVideo(job.SourcePath); detectErr == nil {
+            sources = append(sources, job.SourcePath)
         } else {
-            err = fmt.Errorf("not a video file")
-            log.Printf("Error: %s is not a video file\n", job.SourcePath)
+            err = fmt.Errorf("not a video file: %v", detectErr)
+            log.Printf("Error: %s is not a video file: %v\n", job.SourcePath, detectErr)
         }
     }
 
-    if err != nil {
+    // Every file and rendition is known up front so progress can be
+    // reported against the whole job
+    if err == nil && retry && len(sources) > 0 {
+        // The concat mezzanine of a retry is a fresh file
+        job.Lock()
+        for _, file := range job.Files {
+            file.Path = sources[0]
+        }
+        job.Unlock()
+    } else if err == nil && !retry {
+        for _, source := range sources {
+            files, fileErr := c.newMediaFiles(job, source)
+            if fileErr != nil {
+                if !job.ContinueOnError {
+                    err = fileErr
+                    break
+                }
+                log.Printf("Skipping %s: %v\n", source, fileErr)
+                files = []*models.MediaFile{failedMediaFile(source, fileErr)}
+            }
+            job.Lock()
+            job.Files = append(job.Files, files...)
+            job.Unlock()
+        }
+    }
+    if err == nil {
+        job.LaidOut = true
+        err = c.layoutFailedFiles(job)
+    }
+    job.Lock()
+    job.Progress.FilesTotal = len(job.Files)
+    job.Unlock()
+
+    if err == nil {
+        err = c.processFiles(job)
+    }
+
+    job.Lock()
+    defer job.Unlock()
+    job.Results = mediaResults(job)
+
+    failed := 0
+    for _, file := range job.Files {
+        if file.Status == "failed" {
+            failed++
+        }
+    }
+    if err == nil && failed > 0 && failed < len(job.Files) {
+        log.Printf("Job completed with %d failed files\n", failed)
+        job.Status = "completed_with_errors"
+        job.Error = fmt.Sprintf("%d of %d files failed", failed, len(job.Files))
+    } else if err == nil && failed > 0 {
+        log.Printf("Every file of job %s failed\n", job.ID)
+        job.Status = "failed"
+        job.Error = "every file failed"
+    } else if err != nil {
         log.Printf("Job failed: %v\n", err)
         job.Status = "failed"
         job.Error = err.Error()
@@ -138,113 +551,468 @@ func (c *MediaController) processMediaJob(job *models.MediaJob) {
     job.EndTime = time.Now()
 }
 
-func (c *MediaController) processVideo(job *models.MediaJob, videoPath string) error {
-    job.CurrentFile = videoPath
-    log.Printf("Starting processing for video: %s\n", videoPath)
-    log.Printf("Target codec: %s, Container: %s\n", job.CodecType, job.ContainerFormat)
-    
+// processFiles works through the pending files of a job, up to Parallelism
+// at a time. Unless the job continues on errors, the first failure stops
+// files that have not started yet; the ones already running finish.
+func (c *MediaController) processFiles(job *models.MediaJob) error {
+    var firstErr error
+    sem := make(chan struct{}, job.Parallelism)
+    var wg sync.WaitGroup
+
+    for _, file := range job.Files {
+        if file.Status != "pending" {
+            continue
+        }
+        sem <- struct{}{}
+        job.Lock()
+        failed := firstErr != nil && !job.ContinueOnError
+        job.Unlock()
+        if failed {
+            <-sem
+            break
+        }
+
+        wg.Add(1)
+        go func(file *models.MediaFile) {
+            defer wg.Done()
+            defer func() { <-sem }()
+
+            err := c.processFile(job, file)
+            recordOutputs(job, file, err)
+
+            job.Lock()
+            defer job.Unlock()
+            if err != nil {
+                log.Printf("Error processing video %s: %v\n", file.Path, err)
+                file.Status = "failed"
+                file.Error = err.Error()
+                if firstErr == nil {
+                    firstErr = err
+                }
+                return
+            }
+            file.Status = "completed"
+            job.ProcessedFiles = append(job.ProcessedFiles, file.Path)
+            job.Progress.FilesCompleted++
+        }(file)
+    }
+    wg.Wait()
+    if job.ContinueOnError {
+        // Failures are reported per file
+        return nil
+    }
+    return firstErr
+}
+
+// processFile runs every step the job asks for on one file
+func (c *MediaController) processFile(job *models.MediaJob, file *models.MediaFile) error {
+    if err := c.processVideo(job, file); err != nil {
+        return err
+    }
+    if job.Thumbnails != nil {
+        if err := generatePreviews(job, file); err != nil {
+            return err
+        }
+    }
+    if job.Subtitles != nil {
+        if err := processSubtitles(job, file); err != nil {
+            return err
+        }
+    }
+    if job.Scenes != nil && job.Scenes.Split {
+        return splitScenes(job, file)
+    }
+    return nil
+}
+
+// newMediaFiles probes a source and lays out the files it will produce, one
+// per clip or a single one for the whole source
+func (c *MediaController) newMediaFiles(job *models.MediaJob, videoPath string) ([]*models.MediaFile, error) {
+    var duration float64
+    probe, err := probeMedia(videoPath)
+    if err != nil {
+        log.Printf("Could not probe %s: %v\n", videoPath, err)
+    } else {
+        duration = probe.Duration
+    }
+
     baseFile := filepath.Base(videoPath)
     fileName := strings.TrimSuffix(baseFile, filepath.Ext(baseFile))
+    if len(job.Concat) > 0 {
+        fileName = "concat"
+    }
+
+    if len(job.Clips) == 0 {
+        file, err := c.newMediaFile(job, videoPath, fileName, probe, duration, nil)
+        if err != nil {
+            return nil, err
+        }
+        return []*models.MediaFile{file}, nil
+    }
+
+    ranges, err := clipRanges(job, duration)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", videoPath, err)
+    }
+    var files []*models.MediaFile
+    for _, clip := range ranges {
+        name := fmt.Sprintf("%s_clip%02d", fileName, clip.Index)
+        file, err := c.newMediaFile(job, videoPath, name, probe, clip.End-clip.Start, clip)
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, file)
+    }
+    return files, nil
+}
+
+// newMediaFile lays out the renditions of one source or clip
+func (c *MediaController) newMediaFile(job *models.MediaJob, videoPath, fileName string, probe *models.ProbeResult, duration float64, clip *models.ClipRange) (*models.MediaFile, error) {
+    file := &models.MediaFile{
+        Path:       videoPath,
+        Name:       fileName,
+        Clip:       clip,
+        Duration:   duration,
+        Probe:      probe,
+        Status:     "pending",
+        Renditions: make([]*models.RenditionOutput, 0, len(job.Resolutions)),
+    }
+
+    // Fast clips are copied as they are, into the source's container
+    if clip != nil && !clip.Accurate {
+        outputPath, err := safeJoin(job.DestinationPath, fileName+copyExtension(videoPath, probe))
+        if err != nil {
+            return nil, err
+        }
+        file.Renditions = append(file.Renditions, &models.RenditionOutput{
+            OutputPath: outputPath,
+            Status:     "pending",
+        })
+        return file, nil
+    }
+
     ext := getContainerExtension(job.ContainerFormat)
 
+    if job.OutputMode == models.OutputHLS || job.OutputMode == models.OutputDASH {
+        if err := layoutAdaptive(job, file, fileName); err != nil {
+            return nil, err
+        }
+        return file, nil
+    }
+
     for _, resolution := range job.Resolutions {
-        width, height := resolution.GetDimensions()
-        outputPath := filepath.Join(job.DestinationPath, 
+        outputPath, err := safeJoin(job.DestinationPath, 
             fmt.Sprintf("%s_%s_%s%s", 
                 fileName, 
                 string(job.CodecType), 
                 string(resolution),
                 ext))
+        if err != nil {
+            return nil, err
+        }
+        rendition, err := newRendition(job, file, resolution, outputPath)
+        if err != nil {
+            return nil, err
+        }
+        file.Renditions = append(file.Renditions, rendition)
+    }
 
-        log.Printf("Processing resolution %s (%dx%d)\n", resolution, width, height)
-        log.Printf("Output path: %s\n", outputPath)
+    return file, nil
+}
 
-        args := []string{
-            "-i", videoPath,
-            "-c:v", getFFmpegCodec(job.CodecType)}
+// newRendition sizes a rendition against its source. Renditions that would
+// be taller than the source are skipped rather than upscaled.
+func newRendition(job *models.MediaJob, file *models.MediaFile, resolution models.Resolution, outputPath string) (*models.RenditionOutput, error) {
+    plan, err := renditionScale(job, file, resolution)
+    if err != nil {
+        return nil, err
+    }
 
-        switch job.CodecType {
-        case models.VP9:
-            args = append(args, "-b:v", "0", "-crf", "31", "-deadline", "good", "-cpu-used", "4")
-        case models.H265:
-            args = append(args, "-crf", "28", "-preset", "medium", "-x265-params", "log-level=error")
-        case models.AV1:
-            args = append(args, "-crf", "30", "-strict", "experimental", "-cpu-used", "4")
-        default: // H264
-            args = append(args, "-crf", "23", "-preset", "medium", "-movflags", "+faststart")
-        }
+    rendition := &models.RenditionOutput{
+        Resolution: resolution,
+        OutputPath: outputPath,
+        Width:      plan.width,
+        Height:     plan.height,
+        Status:     "pending",
+    }
+    if plan.upscale {
+        log.Printf("Skipping %s of %s, it is taller than the source\n", resolution, file.Path)
+        rendition.Status = "skipped"
+    }
+    return rendition, nil
+}
 
-        filterString := buildFilterString(job.Filters, width, height)
-        args = append(args, "-vf", filterString, "-progress", "pipe:1")
+func (c *MediaController) processVideo(job *models.MediaJob, file *models.MediaFile) error {
+    videoPath := file.Path
+    job.Lock()
+    job.CurrentFile = videoPath
+    file.Status = "in_progress"
+    job.Unlock()
+    log.Printf("Starting processing for video: %s\n", videoPath)
 
-        switch job.ContainerFormat {
-        case models.WebM:
-            args = append(args, "-f", "webm")
-        case models.MKV:
-            args = append(args, "-f", "matroska")
-        case models.AVI:
-            args = append(args, "-f", "avi")
-        default: // MP4
-            args = append(args, "-f", "mp4")
+    // Scenes are found once per file, ahead of the renditions that carry
+    // them as chapters
+    if job.Scenes != nil && file.Scenes == nil {
+        if err := detectScenes(job, file); err != nil {
+            return err
         }
+    }
 
-        args = append(args, "-c:a", "copy", outputPath)
-
-        cmd := exec.Command("ffmpeg", args...)
-        log.Printf("Executing command: ffmpeg %v\n", args)
+    if file.Clip != nil && !file.Clip.Accurate {
+        if file.Renditions[0].Status == "completed" {
+            return nil
+        }
+        return c.copyClip(job, file)
+    }
 
-        stdout, err := cmd.StdoutPipe()
+    // Loudness is measured once per source and reused by every rendition
+    if job.Audio != nil && job.Audio.Loudnorm != nil && file.Loudness == nil {
+        tracks, err := selectAudioTracks(job, file)
         if err != nil {
-            log.Printf("Error creating stdout pipe: %v\n", err)
             return err
         }
+        if len(tracks) > 0 {
+            measured, err := measureLoudness(inputArgs(file), tracks[0].spec,
+                audioStepChain(job.Audio.Filters, file.Duration), job.Audio.Loudnorm)
+            if err != nil {
+                return err
+            }
+            job.Lock()
+            file.Loudness = measured
+            job.Unlock()
+        }
+    }
 
-        stderr, err := cmd.StderrPipe()
-        if err != nil {
-            log.Printf("Error creating stderr pipe: %v\n", err)
+    if job.Ladder != nil && job.Ladder.Mode == "auto" && file.Ladder == nil {
+        if err := planLadder(job, file); err != nil {
             return err
         }
+        updateJobProgress(job, nil)
+    }
+
+    if job.OutputMode == models.OutputHLS || job.OutputMode == models.OutputDASH {
+        // The ladder is packaged in one run, a retry redoes all of it
+        for _, rendition := range activeRenditions(file.Renditions) {
+            if rendition.Status != "completed" {
+                return c.processAdaptive(job, file)
+            }
+        }
+        return nil
+    }
+
+    log.Printf("Target codec: %s, Container: %s\n", job.CodecType, job.ContainerFormat)
+
+    rate, err := resolveVideoRate(job, file)
+    if err != nil {
+        return err
+    }
 
-        if err := cmd.Start(); err != nil {
-            log.Printf("Error starting FFmpeg: %v\n", err)
+    var chunks []encodeChunk
+    if job.Chunking != nil {
+        if chunks, err = planChunks(job, file); err != nil {
             return err
         }
+    }
+
+    // With continueOnError the remaining renditions still run and the
+    // first failure is returned at the end
+    var renditionErr error
+    for _, rendition := range file.Renditions {
+        if rendition.Status == "skipped" || rendition.Status == "completed" {
+            continue
+        }
+        setRenditionStatus(job, rendition, "in_progress")
 
-        go func() {
-            scanner := bufio.NewScanner(stdout)
-            for scanner.Scan() {
-                log.Printf("FFmpeg progress: %s\n", scanner.Text())
+        renditionRate := rate
+        if rendition.CRF > 0 {
+            renditionRate.crf = rendition.CRF
+        }
+        if chunks != nil {
+            err = c.encodeChunked(job, file, rendition, renditionRate, chunks)
+        } else {
+            err = c.encodeRendition(job, file, rendition, renditionRate)
+        }
+        if err != nil {
+            failRendition(job, rendition, err)
+            if !job.ContinueOnError {
+                return err
             }
-        }()
+            log.Printf("Resolution %s of %s failed: %v\n", rendition.Resolution, videoPath, err)
+            if renditionErr == nil {
+                renditionErr = err
+            }
+            continue
+        }
+
+        setRenditionStatus(job, rendition, "completed")
+        log.Printf("Completed processing resolution %s\n", rendition.Resolution)
 
-        go func() {
-            scanner := bufio.NewScanner(stderr)
-            for scanner.Scan() {
-                log.Printf("FFmpeg output: %s\n", scanner.Text())
+        if job.Quality != nil {
+            if err := measureQuality(job, file, rendition, 0); err != nil {
+                failRendition(job, rendition, err)
+                if !job.ContinueOnError {
+                    return err
+                }
+                if renditionErr == nil {
+                    renditionErr = err
+                }
             }
-        }()
+        }
+    }
+    if renditionErr != nil {
+        return renditionErr
+    }
 
-        if err := cmd.Wait(); err != nil {
-            log.Printf("FFmpeg command failed: %v\n", err)
+    log.Printf("Completed processing video: %s\n", videoPath)
+    return nil
+}
+
+// encodeRendition writes one standalone output file. Pass logs and chapter
+// metadata live in a work directory of its own so concurrent jobs never
+// read each other's statistics.
+func (c *MediaController) encodeRendition(job *models.MediaJob, file *models.MediaFile, rendition *models.RenditionOutput, rate videoRate) error {
+    log.Printf("Processing resolution %s (%dx%d)\n", rendition.Resolution, rendition.Width, rendition.Height)
+    log.Printf("Output path: %s\n", rendition.OutputPath)
+
+    workDir, err := os.MkdirTemp("", "encode-"+job.ID+"-")
+    if err != nil {
+        return fmt.Errorf("failed to create work directory: %v", err)
+    }
+    defer os.RemoveAll(workDir)
+
+    chapters, err := chapterFile(job, file, workDir)
+    if err != nil {
+        return err
+    }
+
+    if !rate.twoPass {
+        args, err := encodeArgs(job, file, rendition, rate, 0, "", chapters)
+        if err != nil {
             return err
         }
-
-        log.Printf("Completed processing resolution %s\n", resolution)
+        return runFFmpeg(args, func(p ffmpegProgress) {
+            updateRenditionProgress(job, file, rendition, p)
+        })
     }
 
-    log.Printf("Completed processing video: %s\n", videoPath)
+    passLog := filepath.Join(workDir, "pass")
+
+    // Each pass covers half of the rendition's progress
+    for pass := 1; pass <= 2; pass++ {
+        offset := float64(pass-1) * file.Duration / 2
+        args, err := encodeArgs(job, file, rendition, rate, pass, passLog, chapters)
+        if err != nil {
+            return err
+        }
+        err = runFFmpeg(args, func(p ffmpegProgress) {
+            p.OutTime = offset + p.OutTime/2
+            p.Speed /= 2
+            if pass == 1 {
+                p.Done = false
+                p.TotalSize = 0
+            }
+            updateRenditionProgress(job, file, rendition, p)
+        })
+        if err != nil {
+            return fmt.Errorf("pass %d failed: %v", pass, err)
+        }
+    }
     return nil
 }
 
-func isVideoFile(path string) bool {
-    ext := strings.ToLower(filepath.Ext(path))
-    videoExts := []string{".mp4", ".avi", ".mkv", ".mov", ".wmv", ".flv", ".webm"}
-    for _, videoExt := range videoExts {
-        if ext == videoExt {
-            return true
+// encodeArgs builds the ffmpeg arguments for one rendition. pass is 0 for a
+// single-pass encode; the first of two passes only analyses the video.
+func encodeArgs(job *models.MediaJob, file *models.MediaFile, rendition *models.RenditionOutput, rate videoRate, pass int, passLog, chapters string) ([]string, error) {
+    plan, err := renditionScale(job, file, rendition.Resolution)
+    if err != nil {
+        return nil, err
+    }
+
+    var x265Params, passArgs []string
+    if pass > 0 {
+        if job.CodecType == models.H265 {
+            // libx265 ignores -pass and takes its stats file as a parameter
+            x265Params = append(x265Params, fmt.Sprintf("pass=%d", pass), "stats="+passLog+".log")
+        } else {
+            passArgs = []string{"-pass", strconv.Itoa(pass), "-passlogfile", passLog}
         }
     }
-    return false
+
+    chapterInput, chapterOutput := chapterArgs(job.Filters, chapters)
+    input := encodeInput{args: inputArgs(file), extra: chapterInput}
+    args, err := videoArgs(job, file, plan, rate, input, x265Params)
+    if err != nil {
+        return nil, err
+    }
+    args = append(args, passArgs...)
+    args = append(args, "-progress", "pipe:1")
+
+    if pass == 1 {
+        return append(args, "-an", "-f", "null", "-"), nil
+    }
+
+    tracks, err := selectAudioTracks(job, file)
+    if err != nil {
+        return nil, err
+    }
+    args = append(args, containerArgs(job.ContainerFormat)...)
+    args = append(args, audioMapArgs(job, tracks)...)
+    args = append(args, audioArgs(job, file)...)
+    args = append(args, subtitleArgs(job, file)...)
+    args = append(args, chapterOutput...)
+    return append(args, rendition.OutputPath), nil
+}
+
+// encodeInput is the source side of an encode
+type encodeInput struct {
+    args   []string // Opens the source, seeking for clips and chunks
+    offset float64  // Where the input starts on the file's timeline, non-zero for chunks
+    extra  []string // Inputs after the watermark images, such as chapter metadata
+}
+
+// videoArgs builds the inputs and the video half of an encode: the filter
+// graph mapped to the output and the encoder. Inputs starting later than the
+// file are moved onto the file's clock while filtered, so time-based
+// filters act as they would in a single encode.
+func videoArgs(job *models.MediaJob, file *models.MediaFile, plan scalePlan, rate videoRate, input encodeInput, x265Params []string) ([]string, error) {
+    args := append([]string{}, input.args...)
+    args = append(args, watermarkInputs(job.Filters)...)
+    args = append(args, input.extra...)
+    args = append(args, videoCodecArgs(job.CodecType, rate, x265Params...)...)
+
+    chain := plan.filter
+    burnFilter, err := subtitleBurnFilter(job, file)
+    if err != nil {
+        return nil, err
+    }
+    if burnFilter != "" {
+        chain = burnFilter + "," + chain
+    }
+    if steps := videoStepChain(job.Filters, file.Duration, true); steps != "" {
+        chain = steps + "," + chain
+    }
+
+    if input.offset <= 0 {
+        graph := buildFilterString(job.Filters, chain, videoInputPad(file), "vout")
+        return append(args, "-filter_complex", graph, "-map", "[vout]"), nil
+    }
+    chain = fmt.Sprintf("setpts=PTS+%s/TB,%s", formatSeconds(input.offset), chain)
+    graph := buildFilterString(job.Filters, chain, videoInputPad(file), "vfile") + ";[vfile]setpts=PTS-STARTPTS[vout]"
+    return append(args, "-filter_complex", graph, "-map", "[vout]"), nil
+}
+
+// containerArgs selects the muxer for standalone output files
+func containerArgs(format models.ContainerFormat) []string {
+    switch format {
+    case models.WebM:
+        return []string{"-f", "webm"}
+    case models.MKV:
+        return []string{"-f", "matroska"}
+    case models.AVI:
+        return []string{"-f", "avi"}
+    default: // MP4
+        return []string{"-f", "mp4", "-movflags", "+faststart"}
+    }
 }
 
 func getFFmpegCodec(codecType models.CodecType) string {
@@ -275,12 +1043,14 @@ func getContainerExtension(format models.ContainerFormat) string {
     }
 }
 
-// Add this function to build filter string
-func buildFilterString(filters *models.VideoFilter, width, height int) string {
+// buildFilterString builds the filter graph of one rendition from the pad
+// in to the pad out: the scale chain, the picture filters, then any
+// watermarks drawn over the result.
+func buildFilterString(filters *models.VideoFilter, scale, in, out string) string {
     var filterParts []string
 
     // Base scaling filter
-    filterParts = append(filterParts, fmt.Sprintf("scale=%d:%d", width, height))
+    filterParts = append(filterParts, scale)
 
     if filters != nil {
         // GrayScale
@@ -319,5 +1089,12 @@ func buildFilterString(filters *models.VideoFilter, width, height int) string {
         }
     }
 
-    return strings.Join(filterParts, ",")
+    chain := strings.Join(filterParts, ",")
+    if filters == nil || len(filters.Watermarks) == 0 {
+        return fmt.Sprintf("[%s]%s[%s]", in, chain, out)
+    }
+
+    graph := []string{fmt.Sprintf("[%s]%s[%s_base]", in, chain, out)}
+    graph = append(graph, watermarkGraph(filters.Watermarks, out+"_base", out)...)
+    return strings.Join(graph, ";")
 }
\ No newline at end of file
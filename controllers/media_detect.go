@@ -0,0 +1,161 @@
+package controllers
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "task-automation-rig/models"
+)
+
+// containerMagic are signatures of video containers at the start of a file.
+// Ambiguous ones are just as common for audio alone (.m4a, .mka, .ogg,
+// .opus), so ffprobe still has to find a video stream in them.
+var containerMagic = []struct {
+    offset    int
+    magic     []byte
+    ambiguous bool
+}{
+    {4, []byte("ftyp"), true},              // MP4, MOV, M4V, 3GP, but also M4A
+    {4, []byte("moov"), true},              // Older QuickTime
+    {4, []byte("mdat"), true},
+    {4, []byte("wide"), true},
+    {4, []byte("free"), true},
+    {0, []byte{0x1A, 0x45, 0xDF, 0xA3}, true}, // Matroska, WebM, MKA
+    {8, []byte("AVI "), false},             // RIFF AVI
+    {0, []byte("FLV"), true},
+    {0, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11}, true}, // ASF, WMV, WMA
+    {0, []byte{0x00, 0x00, 0x01, 0xBA}, false}, // MPEG program stream, VOB
+    {0, []byte("OggS"), true},              // Ogg Theora, Vorbis, Opus
+    {0, []byte(".RMF"), true},              // RealMedia, RealAudio
+}
+
+// imageMagic are still images, ffprobe reports them as one-frame video
+var imageMagic = [][]byte{
+    {0xFF, 0xD8, 0xFF},                     // JPEG
+    {0x89, 'P', 'N', 'G'},
+    []byte("GIF8"),
+}
+
+// detectVideo reports why a file is not a video source, or nil when it is.
+// Signatures only video containers carry are trusted; anything else is
+// left to ffprobe, which catches extensionless camera files, audio-only
+// files and renamed non-media files alike.
+func detectVideo(path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    header := make([]byte, 512)
+    n, err := io.ReadFull(f, header)
+    f.Close()
+    if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+        return err
+    }
+    header = header[:n]
+    if n == 0 {
+        return fmt.Errorf("empty file")
+    }
+
+    for _, image := range imageMagic {
+        if bytes.HasPrefix(header, image) {
+            return fmt.Errorf("still image")
+        }
+    }
+    for _, sig := range containerMagic {
+        if len(header) >= sig.offset+len(sig.magic) && bytes.Equal(header[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+            if !sig.ambiguous {
+                return nil
+            }
+            break
+        }
+    }
+    if transportStream(header) {
+        return nil
+    }
+
+    probe, err := probeMedia(path)
+    if err != nil {
+        return fmt.Errorf("not a media file: %v", err)
+    }
+    if probe.VideoStream() == nil {
+        return fmt.Errorf("no video stream in %s", probe.Container)
+    }
+    return nil
+}
+
+// transportStream spots MPEG-TS by its sync bytes, every 188 bytes for
+// .ts and every 192 for the timecoded .mts/.m2ts of camcorders
+func transportStream(header []byte) bool {
+    for _, packet := range []struct{ start, size int }{{0, 188}, {4, 192}} {
+        if len(header) < packet.start+2*packet.size+1 {
+            continue
+        }
+        synced := true
+        for i := 0; i < 3; i++ {
+            if header[packet.start+i*packet.size] != 0x47 {
+                synced = false
+            }
+        }
+        if synced {
+            return true
+        }
+    }
+    return false
+}
+
+// skipFile records a file a directory job leaves out
+func skipFile(job *models.MediaJob, path, reason string) {
+    log.Printf("Skipping %s: %s\n", path, reason)
+    job.Lock()
+    job.Skipped = append(job.Skipped, models.SkippedFile{Path: path, Reason: reason})
+    job.Unlock()
+}
+
+// validatePatterns rejects malformed include and exclude globs
+func validatePatterns(request *models.MediaRequest) error {
+    for _, pattern := range append(append([]string{}, request.Include...), request.Exclude...) {
+        if _, err := filepath.Match(pattern, ""); err != nil {
+            return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+        }
+    }
+    if (len(request.Include) > 0 || len(request.Exclude) > 0) && len(request.Concat) > 0 {
+        return fmt.Errorf("include and exclude patterns apply to a source directory, not a concat list")
+    }
+    return nil
+}
+
+// matchPattern reports whether a path inside the source directory matches
+// a glob. Patterns with a slash match the relative path, others the base
+// name at any depth.
+func matchPattern(pattern, rel string) bool {
+    name := filepath.Base(rel)
+    if strings.Contains(pattern, "/") {
+        name = filepath.ToSlash(rel)
+    }
+    matched, _ := filepath.Match(pattern, name)
+    return matched
+}
+
+// excludedBy returns the reason the patterns leave a path out, empty when
+// they keep it. Directories are only checked against the excludes, files
+// inside them may still match an include.
+func excludedBy(job *models.MediaJob, rel string, dir bool) string {
+    for _, pattern := range job.Exclude {
+        if matchPattern(pattern, rel) {
+            return fmt.Sprintf("excluded by %s", pattern)
+        }
+    }
+    if dir || len(job.Include) == 0 {
+        return ""
+    }
+    for _, pattern := range job.Include {
+        if matchPattern(pattern, rel) {
+            return ""
+        }
+    }
+    return "matches no include pattern"
+}
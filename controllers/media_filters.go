@@ -0,0 +1,317 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "path/filepath"
+    "strings"
+    "task-automation-rig/models"
+)
+
+// curvePresets are the presets ffmpeg's curves filter knows
+var curvePresets = []string{
+    "color_negative", "cross_process", "darker", "increase_contrast", "lighter",
+    "linear_contrast", "medium_contrast", "negative", "strong_contrast", "vintage",
+}
+
+// validateFilterSteps checks the video filter steps and fills in their
+// defaults. LUT files have already been confined to the source roots.
+func validateFilterSteps(filters *models.VideoFilter) error {
+    if filters == nil {
+        return nil
+    }
+    if len(filters.Steps) > 32 {
+        return fmt.Errorf("at most 32 filter steps per job")
+    }
+
+    for i := range filters.Steps {
+        step := &filters.Steps[i]
+        switch step.Type {
+        case "crop", "pad":
+            if step.Width < 2 || step.Height < 2 {
+                return fmt.Errorf("filter step %d: %s needs a width and height", i+1, step.Type)
+            }
+            if (step.X != nil && *step.X < 0) || (step.Y != nil && *step.Y < 0) {
+                return fmt.Errorf("filter step %d: x and y must be positive", i+1)
+            }
+            if step.Type == "pad" {
+                if step.Color == "" {
+                    step.Color = "black"
+                }
+                if !watermarkColor.MatchString(step.Color) {
+                    return fmt.Errorf("filter step %d: invalid color %s", i+1, step.Color)
+                }
+            }
+        case "fps":
+            if step.FPS <= 0 || step.FPS > 240 {
+                return fmt.Errorf("filter step %d: fps must be between 0 and 240", i+1)
+            }
+        case "transpose":
+            switch step.Direction {
+            case "clockwise", "counterclockwise", "180", "hflip", "vflip":
+            default:
+                return fmt.Errorf("filter step %d: unsupported transpose direction %s", i+1, step.Direction)
+            }
+        case "denoise":
+            if step.Strength == 0 {
+                step.Strength = 4
+            }
+            if step.Strength < 0 || step.Strength > 20 {
+                return fmt.Errorf("filter step %d: denoise strength must be between 0 and 20", i+1)
+            }
+        case "sharpen":
+            if step.Strength == 0 {
+                step.Strength = 1
+            }
+            if step.Strength < -2 || step.Strength > 5 {
+                return fmt.Errorf("filter step %d: sharpen strength must be between -2 and 5", i+1)
+            }
+        case "blur":
+            if step.Strength == 0 {
+                step.Strength = 2
+            }
+            if step.Strength < 0 || step.Strength > 50 {
+                return fmt.Errorf("filter step %d: blur strength must be between 0 and 50", i+1)
+            }
+        case "curves":
+            found := false
+            for _, preset := range curvePresets {
+                if step.Preset == preset {
+                    found = true
+                }
+            }
+            if !found {
+                return fmt.Errorf("filter step %d: unsupported curves preset %s", i+1, step.Preset)
+            }
+        case "lut":
+            switch strings.ToLower(filepath.Ext(step.File)) {
+            case ".cube", ".3dl":
+            default:
+                return fmt.Errorf("filter step %d: lut needs a .cube or .3dl file", i+1)
+            }
+        case "fade":
+            if step.Color == "" {
+                step.Color = "black"
+            }
+            if !watermarkColor.MatchString(step.Color) {
+                return fmt.Errorf("filter step %d: invalid color %s", i+1, step.Color)
+            }
+            if err := validateFade(step.Direction, step.Start, &step.Duration); err != nil {
+                return fmt.Errorf("filter step %d: %v", i+1, err)
+            }
+        default:
+            return fmt.Errorf("filter step %d: unsupported filter type %s", i+1, step.Type)
+        }
+    }
+    return nil
+}
+
+// validateAudioFilters checks the audio filter steps and fills in their
+// defaults
+func validateAudioFilters(audio *models.AudioOptions) error {
+    if len(audio.Filters) > 32 {
+        return fmt.Errorf("at most 32 audio filter steps per job")
+    }
+
+    for i := range audio.Filters {
+        step := &audio.Filters[i]
+        switch step.Type {
+        case "volume":
+            if step.Gain < -60 || step.Gain > 60 {
+                return fmt.Errorf("audio filter %d: gain must be between -60 and 60 dB", i+1)
+            }
+        case "highpass", "lowpass":
+            if step.Frequency < 10 || step.Frequency > 24000 {
+                return fmt.Errorf("audio filter %d: %s frequency must be between 10 and 24000 Hz", i+1, step.Type)
+            }
+        case "fade":
+            if err := validateFade(step.Direction, step.Start, &step.Duration); err != nil {
+                return fmt.Errorf("audio filter %d: %v", i+1, err)
+            }
+        case "compressor":
+            if step.Threshold == 0 {
+                step.Threshold = -18
+            }
+            if step.Ratio == 0 {
+                step.Ratio = 4
+            }
+            if step.Threshold < -60 || step.Threshold > 0 || step.Ratio < 1 || step.Ratio > 20 {
+                return fmt.Errorf("audio filter %d: compressor threshold must be -60 to 0 dB and ratio 1 to 20", i+1)
+            }
+        case "denoise":
+            if step.Strength == 0 {
+                step.Strength = 12
+            }
+            if step.Strength < 0.01 || step.Strength > 97 {
+                return fmt.Errorf("audio filter %d: denoise strength must be between 0.01 and 97 dB", i+1)
+            }
+        default:
+            return fmt.Errorf("audio filter %d: unsupported filter type %s", i+1, step.Type)
+        }
+    }
+    return nil
+}
+
+// validateFade checks a fade shared by the video and audio chains
+func validateFade(direction string, start float64, duration *float64) error {
+    if direction != "in" && direction != "out" {
+        return fmt.Errorf("fade direction must be in or out")
+    }
+    if *duration == 0 {
+        *duration = 1
+    }
+    if *duration < 0 || *duration > 600 || start < 0 {
+        return fmt.Errorf("fade duration must be up to 600 seconds and start positive")
+    }
+    return nil
+}
+
+// videoStepChain turns the filter steps into a filter chain, empty when
+// there are none. Fade outs without a start end with the file, so they need
+// its duration; fades are left out entirely when the chain runs on
+// something other than the file's own timeline.
+func videoStepChain(filters *models.VideoFilter, duration float64, fades bool) string {
+    if filters == nil {
+        return ""
+    }
+
+    var chain []string
+    for _, step := range filters.Steps {
+        switch step.Type {
+        case "crop":
+            x, y := "(in_w-out_w)/2", "(in_h-out_h)/2"
+            if step.X != nil {
+                x = fmt.Sprint(*step.X)
+            }
+            if step.Y != nil {
+                y = fmt.Sprint(*step.Y)
+            }
+            chain = append(chain, fmt.Sprintf("crop=%d:%d:%s:%s", step.Width, step.Height, x, y))
+        case "pad":
+            x, y := "(ow-iw)/2", "(oh-ih)/2"
+            if step.X != nil {
+                x = fmt.Sprint(*step.X)
+            }
+            if step.Y != nil {
+                y = fmt.Sprint(*step.Y)
+            }
+            chain = append(chain, fmt.Sprintf("pad=%d:%d:%s:%s:color=%s", step.Width, step.Height, x, y, filterColor(step.Color)))
+        case "fps":
+            chain = append(chain, fmt.Sprintf("fps=%g", step.FPS))
+        case "transpose":
+            switch step.Direction {
+            case "clockwise":
+                chain = append(chain, "transpose=1")
+            case "counterclockwise":
+                chain = append(chain, "transpose=2")
+            case "180":
+                chain = append(chain, "hflip,vflip")
+            default: // hflip, vflip
+                chain = append(chain, step.Direction)
+            }
+        case "denoise":
+            // The proportions of hqdn3d's own defaults, scaled by strength
+            s := step.Strength
+            chain = append(chain, fmt.Sprintf("hqdn3d=%g:%g:%g:%g", s, s*0.75, s*1.5, s*1.125))
+        case "sharpen":
+            chain = append(chain, fmt.Sprintf("unsharp=5:5:%g:5:5:0.0", step.Strength))
+        case "blur":
+            chain = append(chain, fmt.Sprintf("gblur=sigma=%g", step.Strength))
+        case "curves":
+            chain = append(chain, "curves=preset="+step.Preset)
+        case "lut":
+            chain = append(chain, "lut3d=file="+filterEscape(step.File))
+        case "fade":
+            if !fades {
+                continue
+            }
+            start, ok := fadeStart(step.Direction, step.Start, step.Duration, duration)
+            if !ok {
+                continue
+            }
+            chain = append(chain, fmt.Sprintf("fade=t=%s:st=%g:d=%g:color=%s", step.Direction, start, step.Duration, filterColor(step.Color)))
+        }
+    }
+    return strings.Join(chain, ",")
+}
+
+// audioStepChain turns the audio filter steps into a filter chain
+func audioStepChain(steps []models.AudioFilterStep, duration float64) string {
+    var chain []string
+    for _, step := range steps {
+        switch step.Type {
+        case "volume":
+            chain = append(chain, fmt.Sprintf("volume=%gdB", step.Gain))
+        case "highpass", "lowpass":
+            chain = append(chain, fmt.Sprintf("%s=f=%g", step.Type, step.Frequency))
+        case "compressor":
+            chain = append(chain, fmt.Sprintf("acompressor=threshold=%gdB:ratio=%g", step.Threshold, step.Ratio))
+        case "denoise":
+            chain = append(chain, fmt.Sprintf("afftdn=nr=%g", step.Strength))
+        case "fade":
+            start, ok := fadeStart(step.Direction, step.Start, step.Duration, duration)
+            if !ok {
+                continue
+            }
+            chain = append(chain, fmt.Sprintf("afade=t=%s:st=%g:d=%g", step.Direction, start, step.Duration))
+        }
+    }
+    return strings.Join(chain, ",")
+}
+
+// fadeStart places a fade on the file's timeline
+func fadeStart(direction string, start, length, duration float64) (float64, bool) {
+    if direction == "in" || start > 0 {
+        return start, true
+    }
+    if duration <= 0 {
+        log.Printf("Skipping fade out, the duration is unknown\n")
+        return 0, false
+    }
+    if duration < length {
+        return 0, true
+    }
+    return duration - length, true
+}
+
+// filteredSource is the video stream as the scaler sees it once the filter
+// steps have cropped, padded, turned or retimed it. Steps work in stored
+// pixels, the sample aspect ratio rides along and turns with the picture.
+func filteredSource(filters *models.VideoFilter, stream *models.ProbeStream) *models.ProbeStream {
+    if filters == nil || len(filters.Steps) == 0 || stream == nil {
+        return stream
+    }
+
+    filtered := *stream
+    // ffmpeg applies the rotation before any filter runs
+    if stream.Rotation == 90 || stream.Rotation == 270 {
+        turnSource(&filtered)
+    }
+    filtered.Rotation = 0
+    for _, step := range filters.Steps {
+        switch step.Type {
+        case "crop", "pad":
+            filtered.Width, filtered.Height = step.Width, step.Height
+        case "transpose":
+            if step.Direction == "clockwise" || step.Direction == "counterclockwise" {
+                turnSource(&filtered)
+            }
+        case "fps":
+            filtered.FrameRate = step.FPS
+        }
+    }
+    return &filtered
+}
+
+// turnSource swaps the sides of a stream turned a quarter
+func turnSource(stream *models.ProbeStream) {
+    stream.Width, stream.Height = stream.Height, stream.Width
+    if stream.SampleAspect > 0 {
+        stream.SampleAspect = 1 / stream.SampleAspect
+    }
+}
+
+// filterColor writes a #RRGGBB color the way ffmpeg filters expect it
+func filterColor(color string) string {
+    return strings.Replace(color, "#", "0x", 1)
+}
@@ -0,0 +1,339 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "task-automation-rig/models"
+)
+
+// autoLadderCandidates are tried when an auto ladder job names no resolutions
+var autoLadderCandidates = []models.Resolution{
+    models.Res360p, models.Res480p, models.Res720p, models.Res1080p, models.Res1440p, models.Res2160p,
+}
+
+// validateLadderOptions checks the ladder block and fills in its defaults
+func validateLadderOptions(request *models.MediaRequest) error {
+    opts := request.Ladder
+    if opts == nil {
+        return nil
+    }
+
+    switch opts.Mode {
+    case "", "fixed":
+        opts.Mode = "fixed"
+        return nil
+    case "auto":
+    default:
+        return fmt.Errorf("unsupported ladder mode: %s", opts.Mode)
+    }
+
+    if request.RateControl != nil && request.RateControl.Mode != models.RateCRF {
+        return fmt.Errorf("the auto ladder picks its own CRF and needs crf rate control")
+    }
+    if len(request.Resolutions) == 0 {
+        request.Resolutions = autoLadderCandidates
+    }
+    if opts.TargetVMAF == 0 {
+        opts.TargetVMAF = 93
+    }
+    if opts.TargetSSIM == 0 {
+        opts.TargetSSIM = 0.98
+    }
+    if opts.SampleCount == 0 {
+        opts.SampleCount = 3
+    }
+    if opts.SampleDuration == 0 {
+        opts.SampleDuration = 4
+    }
+    if opts.MinSpacing == 0 {
+        opts.MinSpacing = 1.5
+    }
+
+    if opts.TargetVMAF < 0 || opts.TargetVMAF > 100 || opts.TargetSSIM < 0 || opts.TargetSSIM > 1 {
+        return fmt.Errorf("ladder targets out of range (vmaf 0..100, ssim 0..1)")
+    }
+    if opts.SampleCount < 1 || opts.SampleCount > 10 || opts.SampleDuration < 1 || opts.SampleDuration > 30 {
+        return fmt.Errorf("ladder samples must number 1 to 10 and last 1 to 30 seconds")
+    }
+    if opts.MinSpacing < 1 {
+        return fmt.Errorf("ladder spacing must be at least 1")
+    }
+    return nil
+}
+
+// crfSearchRange is the span of CRF values the auto ladder searches
+func crfSearchRange(codecType models.CodecType) (int, int) {
+    switch codecType {
+    case models.VP9, models.AV1:
+        return 20, 50
+    case models.H265:
+        return 20, 38
+    default: // H264
+        return 18, 36
+    }
+}
+
+// planLadder test-encodes samples of a source at every candidate rung and
+// keeps the rungs worth encoding. Each rung gets the highest CRF whose score
+// still reaches the target; rungs whose bitrate lies too close to the next
+// rung up add little for the bits and are skipped.
+func planLadder(job *models.MediaJob, file *models.MediaFile) error {
+    opts := job.Ladder
+    log.Printf("Planning auto ladder for: %s\n", file.Path)
+
+    workDir, err := os.MkdirTemp("", "ladder-"+job.ID+"-")
+    if err != nil {
+        return fmt.Errorf("failed to create ladder work directory: %v", err)
+    }
+    defer os.RemoveAll(workDir)
+
+    sample, sampleDuration, err := ladderSample(file, workDir, opts.SampleCount, opts.SampleDuration)
+    if err != nil {
+        return err
+    }
+
+    report := &models.LadderReport{Metric: "ssim", Target: opts.TargetSSIM}
+    if hasLibvmaf() {
+        report.Metric, report.Target = "vmaf", opts.TargetVMAF
+    }
+
+    // Candidates in ascending size, renditions skipped as upscales stay out
+    var candidates []*models.RenditionOutput
+    for _, rendition := range file.Renditions {
+        if rendition.Status != "skipped" {
+            candidates = append(candidates, rendition)
+        }
+    }
+    sort.SliceStable(candidates, func(i, j int) bool {
+        return candidates[i].Width*candidates[i].Height < candidates[j].Width*candidates[j].Height
+    })
+    if len(candidates) == 0 {
+        job.Lock()
+        file.Ladder = report
+        job.Unlock()
+        return nil
+    }
+
+    rungs := make([]models.LadderRung, len(candidates))
+    for i, rendition := range candidates {
+        rung, err := testRung(job, file, rendition, sample, sampleDuration, report, workDir)
+        if err != nil {
+            return err
+        }
+        rungs[i] = rung
+    }
+
+    // Walk down from the top rung, which is always kept
+    kept := len(rungs) - 1
+    rungs[kept].Selected = true
+    if rungs[kept].Reason == "" {
+        rungs[kept].Reason = "top rung"
+    }
+    for i := len(rungs) - 2; i >= 0; i-- {
+        if float64(rungs[i].BitrateKbps)*opts.MinSpacing > float64(rungs[kept].BitrateKbps) {
+            rungs[i].Reason = fmt.Sprintf("needs %d kbps, within %.1fx of %s at %d kbps",
+                rungs[i].BitrateKbps, opts.MinSpacing, rungs[kept].Resolution, rungs[kept].BitrateKbps)
+            continue
+        }
+        rungs[i].Selected = true
+        if rungs[i].Reason == "" {
+            rungs[i].Reason = fmt.Sprintf("reaches the target at %d kbps", rungs[i].BitrateKbps)
+        }
+        kept = i
+    }
+
+    for i, rendition := range candidates {
+        if !rungs[i].Selected {
+            setRenditionStatus(job, rendition, "skipped")
+        }
+    }
+
+    // Report the rungs in requested order, skipped upscales included
+    for _, rendition := range file.Renditions {
+        found := false
+        for i, candidate := range candidates {
+            if candidate == rendition {
+                report.Rungs = append(report.Rungs, rungs[i])
+                found = true
+            }
+        }
+        if !found {
+            report.Rungs = append(report.Rungs, models.LadderRung{
+                Resolution: rendition.Resolution,
+                Width:      rendition.Width,
+                Height:     rendition.Height,
+                Reason:     "taller than the source",
+            })
+        }
+    }
+
+    // The renditions are live, readers see the rung results all at once
+    job.Lock()
+    defer job.Unlock()
+    for i, rendition := range candidates {
+        rung := rungs[i]
+        if !rung.Selected {
+            continue
+        }
+        rendition.CRF = rung.CRF
+        if job.OutputMode != models.OutputFiles {
+            // Peaks run above the sample average, leave headroom in the cap
+            rendition.Bandwidth = int64(float64(rung.BitrateKbps)*1.5) * 1000
+        }
+    }
+    if job.OutputMode != models.OutputFiles {
+        assignVariants(job, file)
+    }
+    file.Ladder = report
+    return nil
+}
+
+// testRung binary-searches the highest CRF at which one rung reaches the
+// target. A rung that misses the target even at the lowest CRF keeps it and
+// says so.
+func testRung(job *models.MediaJob, file *models.MediaFile, rendition *models.RenditionOutput,
+    sample string, sampleDuration float64, report *models.LadderReport, workDir string) (models.LadderRung, error) {
+    rung := models.LadderRung{Resolution: rendition.Resolution, Width: rendition.Width, Height: rendition.Height}
+    plan, err := renditionScale(job, file, rendition.Resolution)
+    if err != nil {
+        return rung, err
+    }
+
+    type result struct {
+        score   float64
+        bitrate int
+    }
+    results := map[int]result{}
+    test := func(crf int) (result, error) {
+        if r, ok := results[crf]; ok {
+            return r, nil
+        }
+        score, bitrate, err := testEncode(job, sample, sampleDuration, plan.filter, crf, report.Metric,
+            filepath.Join(workDir, fmt.Sprintf("test_%s_%d.mkv", rendition.Resolution, crf)))
+        if err != nil {
+            return result{}, err
+        }
+        results[crf] = result{score, bitrate}
+        return results[crf], nil
+    }
+
+    low, high := crfSearchRange(job.CodecType)
+    r, err := test(low)
+    if err != nil {
+        return rung, err
+    }
+    if r.score < report.Target {
+        rung.CRF, rung.Score, rung.BitrateKbps = low, r.score, r.bitrate
+        rung.Reason = fmt.Sprintf("misses the target even at CRF %d", low)
+        return rung, nil
+    }
+
+    best := low
+    for low < high {
+        mid := (low + high + 1) / 2
+        r, err := test(mid)
+        if err != nil {
+            return rung, err
+        }
+        if r.score >= report.Target {
+            low, best = mid, mid
+        } else {
+            high = mid - 1
+        }
+    }
+
+    r = results[best]
+    rung.CRF, rung.Score, rung.BitrateKbps = best, r.score, r.bitrate
+    log.Printf("Auto ladder %s: CRF %d, %d kbps, %s %.3f\n", rendition.Resolution, best, r.bitrate, report.Metric, r.score)
+    return rung, nil
+}
+
+// ladderSample joins short stretches from across the file into one lossless
+// sample, so test encodes see the variety of the whole source in seconds
+func ladderSample(file *models.MediaFile, workDir string, count int, duration float64) (string, float64, error) {
+    if file.Duration <= 0 {
+        return "", 0, fmt.Errorf("the auto ladder needs a known duration")
+    }
+
+    sample := filepath.Join(workDir, "sample.mkv")
+    // Short files are sampled whole
+    if file.Duration <= float64(count)*duration*1.5 {
+        args := append(inputArgs(file), "-map", videoInputPad(file), "-c:v", "libx264", "-qp", "0", "-preset", "ultrafast", sample)
+        if _, err := runFFmpegOutput(args...); err != nil {
+            return "", 0, fmt.Errorf("failed to create ladder sample: %v", err)
+        }
+        return sample, file.Duration, nil
+    }
+
+    var args []string
+    var graph strings.Builder
+    for i := 0; i < count; i++ {
+        start := file.Duration*float64(i+1)/float64(count+1) - duration/2
+        args = append(args, "-ss", formatSeconds(clipOffset(file)+math.Max(start, 0)), "-t", formatSeconds(duration), "-i", file.Path)
+        graph.WriteString(fmt.Sprintf("[%d:%s]", i, strings.TrimPrefix(videoInputPad(file), "0:")))
+    }
+    graph.WriteString(fmt.Sprintf("concat=n=%d:v=1:a=0[sample]", count))
+
+    args = append(args, "-filter_complex", graph.String(), "-map", "[sample]",
+        "-c:v", "libx264", "-qp", "0", "-preset", "ultrafast", sample)
+    if _, err := runFFmpegOutput(args...); err != nil {
+        return "", 0, fmt.Errorf("failed to create ladder sample: %v", err)
+    }
+    return sample, float64(count) * duration, nil
+}
+
+// testEncode encodes the sample at one rung and CRF and scores the result
+// against the full-size sample. The encode is scaled back up to the
+// reference for scoring, so what the rung loses by downscaling counts
+// against it as much as what the encoder loses. Filter steps run on both
+// sides, the sample has to match the geometry the rung was planned for.
+func testEncode(job *models.MediaJob, sample string, sampleDuration float64, scale string, crf int, metric, output string) (float64, int, error) {
+    reference := "null"
+    if steps := videoStepChain(job.Filters, 0, false); steps != "" {
+        scale = steps + "," + scale
+        reference = steps
+    }
+    args := []string{"-i", sample, "-vf", scale}
+    args = append(args, videoCodecArgs(job.CodecType, videoRate{crf: crf})...)
+    args = append(args, "-an", output)
+    if _, err := runFFmpegOutput(args...); err != nil {
+        return 0, 0, fmt.Errorf("ladder test encode failed: %v", err)
+    }
+
+    info, err := os.Stat(output)
+    if err != nil {
+        return 0, 0, err
+    }
+    bitrate := int(float64(info.Size()) * 8 / 1000 / sampleDuration)
+
+    filter := "ssim"
+    if metric == "vmaf" {
+        filter = "libvmaf"
+    }
+    graph := fmt.Sprintf("[1:v]%s,setpts=PTS-STARTPTS,format=yuv420p[full];[0:v]setpts=PTS-STARTPTS[encoded];"+
+        "[encoded][full]scale2ref=flags=bicubic[upscaled][ref];[upscaled]format=yuv420p[dist];[dist][ref]%s",
+        reference, filter)
+    scoreOutput, err := runFFmpegOutput("-hide_banner", "-i", output, "-i", sample, "-filter_complex", graph, "-f", "null", "-")
+    if err != nil {
+        return 0, 0, fmt.Errorf("ladder scoring failed: %v", err)
+    }
+
+    pattern := ssimScore
+    if metric == "vmaf" {
+        pattern = vmafScore
+    }
+    m := pattern.FindAllStringSubmatch(scoreOutput, -1)
+    if m == nil {
+        return 0, 0, fmt.Errorf("no %s score in ffmpeg output", metric)
+    }
+    score, _ := strconv.ParseFloat(m[len(m)-1][1], 64)
+
+    os.Remove(output)
+    return score, bitrate, nil
+}
@@ -0,0 +1,296 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "task-automation-rig/models"
+)
+
+// layoutAdaptive places the package for one source in its own directory
+// and points every rendition at its variant playlist (HLS) or at the shared
+// MPD (DASH).
+func layoutAdaptive(job *models.MediaJob, file *models.MediaFile, fileName string) error {
+    packageDir, err := safeJoin(job.DestinationPath,
+        fmt.Sprintf("%s_%s_%s", fileName, string(job.CodecType), string(job.OutputMode)))
+    if err != nil {
+        return err
+    }
+
+    if job.OutputMode == models.OutputHLS {
+        file.Manifest = filepath.Join(packageDir, "master.m3u8")
+    } else {
+        file.Manifest = filepath.Join(packageDir, "manifest.mpd")
+    }
+
+    for _, resolution := range job.Resolutions {
+        rendition, err := newRendition(job, file, resolution, file.Manifest)
+        if err != nil {
+            return err
+        }
+        rendition.Bandwidth = int64(ladderBitrate(job.CodecType, rendition.Width, rendition.Height)) * 1000
+        file.Renditions = append(file.Renditions, rendition)
+    }
+    assignVariants(job, file)
+    return nil
+}
+
+// assignVariants numbers the variant directories over the renditions
+// actually encoded. It runs again once the auto ladder has skipped rungs,
+// under the job lock since the file is live by then.
+func assignVariants(job *models.MediaJob, file *models.MediaFile) {
+    packageDir := filepath.Dir(file.Manifest)
+    variant := 0
+    for _, rendition := range file.Renditions {
+        if rendition.Status == "skipped" {
+            rendition.OutputPath = ""
+            continue
+        }
+        rendition.OutputPath = file.Manifest
+        if job.OutputMode == models.OutputHLS {
+            rendition.OutputPath = filepath.Join(packageDir, fmt.Sprintf("stream_%d", variant), "index.m3u8")
+        }
+        variant++
+    }
+}
+
+// activeRenditions drops the renditions that were skipped
+func activeRenditions(renditions []*models.RenditionOutput) []*models.RenditionOutput {
+    var active []*models.RenditionOutput
+    for _, rendition := range renditions {
+        if rendition.Status != "skipped" {
+            active = append(active, rendition)
+        }
+    }
+    return active
+}
+
+// processAdaptive encodes the whole ladder of one source in a single ffmpeg
+// run so every rendition shares the same keyframe positions, then segments
+// it into HLS or DASH.
+func (c *MediaController) processAdaptive(job *models.MediaJob, file *models.MediaFile) error {
+    packageDir := filepath.Dir(file.Manifest)
+    if err := os.MkdirAll(packageDir, 0755); err != nil {
+        return fmt.Errorf("failed to create package directory: %v", err)
+    }
+    log.Printf("Packaging %s as %s into %s\n", file.Path, job.OutputMode, packageDir)
+
+    segment := job.Packaging.SegmentDuration
+    renditions := activeRenditions(file.Renditions)
+    if len(renditions) == 0 {
+        log.Printf("Every rendition of %s is taller than the source, nothing to package\n", file.Path)
+        return nil
+    }
+    tracks, err := selectAudioTracks(job, file)
+    if err != nil {
+        return err
+    }
+
+    // Split the decoded source once and scale each branch to its rendition.
+    // Filter steps and burned-in subtitles run once, ahead of the split.
+    burnFilter, err := subtitleBurnFilter(job, file)
+    if err != nil {
+        return err
+    }
+    if burnFilter != "" {
+        burnFilter += ","
+    }
+    if steps := videoStepChain(job.Filters, file.Duration, true); steps != "" {
+        burnFilter = steps + "," + burnFilter
+    }
+    var graph strings.Builder
+    graph.WriteString(fmt.Sprintf("[%s]%ssplit=%d", videoInputPad(file), burnFilter, len(renditions)))
+    for i := range renditions {
+        graph.WriteString(fmt.Sprintf("[s%d]", i))
+    }
+    for i, rendition := range renditions {
+        plan, err := renditionScale(job, file, rendition.Resolution)
+        if err != nil {
+            return err
+        }
+        graph.WriteString(";" + buildFilterString(job.Filters, plan.filter, fmt.Sprintf("s%d", i), fmt.Sprintf("v%d", i)))
+    }
+
+    args := append(inputArgs(file), watermarkInputs(job.Filters)...)
+    args = append(args, "-filter_complex", graph.String())
+    for i := range renditions {
+        args = append(args, "-map", fmt.Sprintf("[v%d]", i))
+    }
+    if len(tracks) > 0 {
+        // Shared audio renditions referenced by every variant
+        args = append(args, audioMapArgs(job, tracks)...)
+        args = append(args, audioArgs(job, file)...)
+    }
+
+    rate, err := resolveVideoRate(job, file)
+    if err != nil {
+        return err
+    }
+    args = append(args, videoCodecArgs(job.CodecType, rate, "scenecut=0")...)
+    for i, rendition := range renditions {
+        if rendition.CRF > 0 {
+            args = append(args, fmt.Sprintf("-crf:v:%d", i), strconv.Itoa(rendition.CRF))
+        }
+        kbps := rendition.Bandwidth / 1000
+        switch job.CodecType {
+        case models.VP9, models.AV1:
+            // Constrained quality: CRF with a bitrate ceiling
+            args = append(args, fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", kbps))
+        default:
+            // The VBV cap is what the muxers advertise as bandwidth
+            args = append(args,
+                fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", kbps),
+                fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", kbps*2))
+        }
+    }
+
+    // Identical keyframe positions in every rendition let players switch
+    // at any segment boundary
+    args = append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segment))
+    if file.Probe != nil {
+        if stream := filteredSource(job.Filters, file.Probe.VideoStream()); stream != nil && stream.FrameRate > 0 {
+            gop := int(math.Round(stream.FrameRate * float64(segment)))
+            args = append(args, "-g", fmt.Sprint(gop), "-keyint_min", fmt.Sprint(gop))
+        }
+    }
+    switch job.CodecType {
+    case models.H264:
+        args = append(args, "-sc_threshold", "0")
+    case models.H265:
+        // Apple players only accept HEVC tagged as hvc1
+        args = append(args, "-tag:v", "hvc1")
+    }
+
+    if job.OutputMode == models.OutputHLS {
+        args = append(args, hlsArgs(job, packageDir, len(renditions), tracks)...)
+    } else {
+        args = append(args, dashArgs(job, len(renditions), tracks)...)
+    }
+    args = append(args, "-progress", "pipe:1")
+
+    if job.OutputMode == models.OutputHLS {
+        args = append(args, filepath.Join(packageDir, "stream_%v", "index.m3u8"))
+    } else {
+        args = append(args, file.Manifest)
+    }
+
+    for _, rendition := range renditions {
+        setRenditionStatus(job, rendition, "in_progress")
+    }
+    updateJobProgress(job, renditions[0])
+
+    err = runFFmpeg(args, func(p ffmpegProgress) {
+        // One process writes every rendition, attribute its size only once
+        for i, rendition := range renditions {
+            if i > 0 {
+                p.TotalSize = 0
+            }
+            updateRenditionProgress(job, file, rendition, p)
+        }
+    })
+
+    for _, rendition := range renditions {
+        if err != nil {
+            setRenditionStatus(job, rendition, "failed")
+            continue
+        }
+        setRenditionStatus(job, rendition, "completed")
+    }
+    if err != nil {
+        return err
+    }
+    updateJobProgress(job, renditions[0])
+
+    if job.Quality != nil {
+        for i, rendition := range renditions {
+            if err := measureQuality(job, file, rendition, i); err != nil {
+                setRenditionStatus(job, rendition, "failed")
+                return err
+            }
+        }
+    }
+
+    log.Printf("Completed packaging video: %s\n", file.Path)
+    return nil
+}
+
+func hlsArgs(job *models.MediaJob, packageDir string, variants int, tracks []audioTrack) []string {
+    segmentType, segmentExt := "mpegts", "ts"
+    if job.Packaging.FMP4 {
+        segmentType, segmentExt = "fmp4", "m4s"
+    }
+
+    // Every video variant points at the shared audio group, which holds one
+    // rendition per audio track
+    var streamMap []string
+    for i := 0; i < variants; i++ {
+        if len(tracks) > 0 {
+            streamMap = append(streamMap, fmt.Sprintf("v:%d,agroup:audio", i))
+        } else {
+            streamMap = append(streamMap, fmt.Sprintf("v:%d", i))
+        }
+    }
+    for i, track := range tracks {
+        entry := fmt.Sprintf("a:%d,agroup:audio,name:%s", i, hlsTrackName(track, i))
+        if track.language != "" {
+            entry += ",language:" + track.language
+        }
+        if track.def {
+            entry += ",default:yes"
+        }
+        streamMap = append(streamMap, entry)
+    }
+
+    return []string{
+        "-f", "hls",
+        "-hls_time", fmt.Sprint(job.Packaging.SegmentDuration),
+        "-hls_playlist_type", "vod",
+        "-hls_flags", "independent_segments",
+        "-hls_segment_type", segmentType,
+        "-hls_segment_filename", filepath.Join(packageDir, "stream_%v", "segment_%05d."+segmentExt),
+        "-master_pl_name", "master.m3u8",
+        "-var_stream_map", strings.Join(streamMap, " "),
+    }
+}
+
+func dashArgs(job *models.MediaJob, variants int, tracks []audioTrack) []string {
+    // Each audio track is its own adaptation set so players can tell the
+    // languages apart; the audio streams follow the video variants
+    adaptationSets := "id=0,streams=v"
+    for i := range tracks {
+        adaptationSets += fmt.Sprintf(" id=%d,streams=%d", i+1, variants+i)
+    }
+
+    return []string{
+        "-f", "dash",
+        "-seg_duration", fmt.Sprint(job.Packaging.SegmentDuration),
+        "-use_template", "1",
+        "-use_timeline", "1",
+        "-dash_segment_type", "mp4",
+        "-adaptation_sets", adaptationSets,
+        "-init_seg_name", "init-$RepresentationID$.$ext$",
+        "-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.$ext$",
+    }
+}
+
+// ladderBitrate is the kbps budget of a rendition. It scales from 5 Mbps
+// H.264 at 1080p by pixel count to the power 0.75, since bitrate needs grow
+// slower than resolution, and newer codecs get proportionally less.
+func ladderBitrate(codecType models.CodecType, width, height int) int {
+    pixels := float64(width*height) / (1920 * 1080)
+    kbps := 5000 * math.Pow(pixels, 0.75)
+
+    switch codecType {
+    case models.H265:
+        kbps *= 0.6
+    case models.VP9:
+        kbps *= 0.65
+    case models.AV1:
+        kbps *= 0.5
+    }
+    return int(math.Round(kbps))
+}
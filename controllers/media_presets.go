@@ -0,0 +1,270 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "sync"
+    "time"
+    "github.com/gofiber/fiber/v2"
+    "task-automation-rig/models"
+)
+
+var presetName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+var errPresetExists = errors.New("a preset with this name already exists")
+
+// presetStore keeps the named presets, mirrored to a JSON file when one is
+// configured
+type presetStore struct {
+    mu      sync.RWMutex
+    path    string
+    presets map[string]*models.MediaPreset
+}
+
+// newPresetStore loads the presets saved in path. A missing file starts an
+// empty store. A file that cannot be read or parsed stops the server, the
+// first save would otherwise replace it with an empty store.
+func newPresetStore(path string) *presetStore {
+    store := &presetStore{path: path, presets: make(map[string]*models.MediaPreset)}
+    if path == "" {
+        return store
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            log.Fatalf("Failed to read presets from %s: %v\n", path, err)
+        }
+        return store
+    }
+    var presets []*models.MediaPreset
+    if err := json.Unmarshal(data, &presets); err != nil {
+        log.Fatalf("Failed to parse presets in %s: %v\n", path, err)
+    }
+    for _, preset := range presets {
+        store.presets[preset.Name] = preset
+    }
+    log.Printf("Loaded %d media presets from %s\n", len(presets), path)
+    return store
+}
+
+// list returns the presets sorted by name
+func (s *presetStore) list() []*models.MediaPreset {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    list := make([]*models.MediaPreset, 0, len(s.presets))
+    for _, preset := range s.presets {
+        list = append(list, preset)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list
+}
+
+func (s *presetStore) get(name string) (*models.MediaPreset, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    preset, exists := s.presets[name]
+    return preset, exists
+}
+
+// put stores a preset and saves the store. Unless replace is set an
+// existing name is refused, checked under the same lock as the write. A
+// failed save leaves the store as it was.
+func (s *presetStore) put(preset *models.MediaPreset, replace bool) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    previous, existed := s.presets[preset.Name]
+    if existed && !replace {
+        return errPresetExists
+    }
+    s.presets[preset.Name] = preset
+    if err := s.save(); err != nil {
+        if existed {
+            s.presets[preset.Name] = previous
+        } else {
+            delete(s.presets, preset.Name)
+        }
+        return err
+    }
+    return nil
+}
+
+func (s *presetStore) remove(name string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    preset, exists := s.presets[name]
+    if !exists {
+        return false, nil
+    }
+    delete(s.presets, name)
+    if err := s.save(); err != nil {
+        s.presets[name] = preset
+        return true, err
+    }
+    return true, nil
+}
+
+// save writes the presets through a temporary file so a crash never
+// leaves half a file behind. Callers hold mu.
+func (s *presetStore) save() error {
+    if s.path == "" {
+        return nil
+    }
+
+    list := make([]*models.MediaPreset, 0, len(s.presets))
+    for _, preset := range s.presets {
+        list = append(list, preset)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    data, err := json.MarshalIndent(list, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(s.path), ".presets-*")
+    if err != nil {
+        return fmt.Errorf("failed to save presets: %v", err)
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return fmt.Errorf("failed to save presets: %v", err)
+    }
+    if err := tmp.Close(); err != nil {
+        return fmt.Errorf("failed to save presets: %v", err)
+    }
+    if err := os.Rename(tmp.Name(), s.path); err != nil {
+        return fmt.Errorf("failed to save presets: %v", err)
+    }
+    return nil
+}
+
+// presetSettings returns a deep copy of a preset's settings, so a request
+// decoded on top of it never changes the stored preset
+func presetSettings(preset *models.MediaPreset) (models.MediaRequest, error) {
+    var settings models.MediaRequest
+    data, err := json.Marshal(preset.Settings)
+    if err != nil {
+        return settings, err
+    }
+    err = json.Unmarshal(data, &settings)
+    return settings, err
+}
+
+// validatePreset checks a preset before it is stored. The settings must
+// make a valid job once paths are added; defaults are filled in on a copy
+// so they keep following the server's defaults.
+func validatePreset(preset *models.MediaPreset) error {
+    if !presetName.MatchString(preset.Name) {
+        return fmt.Errorf("preset names are 1 to 64 lowercase letters, digits, dots, dashes or underscores")
+    }
+
+    settings := preset.Settings
+    if settings.SourcePath != "" || settings.DestinationPath != "" || len(settings.Concat) > 0 ||
+        len(settings.Clips) > 0 || settings.Preset != "" {
+        return fmt.Errorf("presets cannot hold paths, clips, concat lists or other presets")
+    }
+
+    check, err := presetSettings(preset)
+    if err != nil {
+        return err
+    }
+    return validateMediaRequest(&check)
+}
+
+// ListPresets returns every stored preset
+func (c *MediaController) ListPresets(ctx *fiber.Ctx) error {
+    return ctx.JSON(c.presets.list())
+}
+
+func (c *MediaController) GetPreset(ctx *fiber.Ctx) error {
+    preset, exists := c.presets.get(ctx.Params("name"))
+    if !exists {
+        return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+            "error": "Preset not found",
+        })
+    }
+    return ctx.JSON(preset)
+}
+
+// CreatePreset stores a new preset, names are never overwritten here
+func (c *MediaController) CreatePreset(ctx *fiber.Ctx) error {
+    var preset models.MediaPreset
+    if err := ctx.BodyParser(&preset); err != nil {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Invalid request body",
+        })
+    }
+    return c.storePreset(ctx, &preset, time.Now(), false)
+}
+
+// UpdatePreset replaces the settings of an existing preset
+func (c *MediaController) UpdatePreset(ctx *fiber.Ctx) error {
+    existing, exists := c.presets.get(ctx.Params("name"))
+    if !exists {
+        return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+            "error": "Preset not found",
+        })
+    }
+
+    var preset models.MediaPreset
+    if err := ctx.BodyParser(&preset); err != nil {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Invalid request body",
+        })
+    }
+    // The name comes from the path, renaming is delete and create
+    preset.Name = existing.Name
+    return c.storePreset(ctx, &preset, existing.CreatedAt, true)
+}
+
+func (c *MediaController) DeletePreset(ctx *fiber.Ctx) error {
+    existed, err := c.presets.remove(ctx.Params("name"))
+    if err != nil {
+        return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    }
+    if !existed {
+        return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+            "error": "Preset not found",
+        })
+    }
+    return ctx.SendStatus(fiber.StatusNoContent)
+}
+
+// storePreset validates and saves a preset. Creating never overwrites a
+// name, updating replaces it.
+func (c *MediaController) storePreset(ctx *fiber.Ctx, preset *models.MediaPreset, created time.Time, replace bool) error {
+    if err := validatePreset(preset); err != nil {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    }
+    preset.CreatedAt = created
+    preset.UpdatedAt = time.Now()
+
+    if err := c.presets.put(preset, replace); err == errPresetExists {
+        return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{
+            "error": "A preset with this name already exists",
+        })
+    } else if err != nil {
+        return ctx.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    }
+    log.Printf("Stored media preset %s\n", preset.Name)
+    if replace {
+        return ctx.JSON(preset)
+    }
+    return ctx.Status(fiber.StatusCreated).JSON(preset)
+}
@@ -0,0 +1,222 @@
+package controllers
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "os/exec"
+    "strconv"
+    "strings"
+    "github.com/gofiber/fiber/v2"
+    "task-automation-rig/models"
+)
+
+// ProbeMedia inspects a media file without starting a job
+func (c *MediaController) ProbeMedia(ctx *fiber.Ctx) error {
+    var request models.ProbeRequest
+    if err := ctx.BodyParser(&request); err != nil {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Invalid request body",
+        })
+    }
+
+    if request.Path == "" {
+        return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+            "error": "Path is required",
+        })
+    }
+
+    path, err := c.sandbox.checkSource(request.Path)
+    if err != nil {
+        return ctx.Status(fiber.StatusForbidden).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    }
+
+    probe, err := probeMedia(path)
+    if err != nil {
+        return ctx.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+            "error": err.Error(),
+        })
+    }
+    return ctx.JSON(probe)
+}
+
+type ffprobeSideData struct {
+    SideDataType string  `json:"side_data_type"`
+    Rotation     float64 `json:"rotation"`
+}
+
+// ffprobeOutput mirrors the parts of ffprobe's JSON writer we use
+type ffprobeOutput struct {
+    Format struct {
+        FormatName     string `json:"format_name"`
+        FormatLongName string `json:"format_long_name"`
+        Duration       string `json:"duration"`
+        Size           string `json:"size"`
+        BitRate        string `json:"bit_rate"`
+    } `json:"format"`
+    Streams []struct {
+        Index          int               `json:"index"`
+        CodecType      string            `json:"codec_type"`
+        CodecName      string            `json:"codec_name"`
+        Profile        string            `json:"profile"`
+        BitRate        string            `json:"bit_rate"`
+        Duration       string            `json:"duration"`
+        Width          int               `json:"width"`
+        Height         int               `json:"height"`
+        RFrameRate     string            `json:"r_frame_rate"`
+        SampleAspect   string            `json:"sample_aspect_ratio"`
+        AvgFrameRate   string            `json:"avg_frame_rate"`
+        PixFmt         string            `json:"pix_fmt"`
+        ColorSpace     string            `json:"color_space"`
+        ColorTransfer  string            `json:"color_transfer"`
+        ColorPrimaries string            `json:"color_primaries"`
+        ColorRange     string            `json:"color_range"`
+        SampleRate     string            `json:"sample_rate"`
+        Channels       int               `json:"channels"`
+        ChannelLayout  string            `json:"channel_layout"`
+        Tags           map[string]string `json:"tags"`
+        Disposition    map[string]int    `json:"disposition"`
+        SideDataList   []ffprobeSideData `json:"side_data_list"`
+    } `json:"streams"`
+    Chapters []struct {
+        ID        int64             `json:"id"`
+        StartTime string            `json:"start_time"`
+        EndTime   string            `json:"end_time"`
+        Tags      map[string]string `json:"tags"`
+    } `json:"chapters"`
+}
+
+// probeMedia runs ffprobe over a file and returns its container, streams
+// and chapters
+func probeMedia(path string) (*models.ProbeResult, error) {
+    output, err := exec.Command("ffprobe", "-v", "error",
+        "-print_format", "json",
+        "-show_format", "-show_streams", "-show_chapters",
+        path).Output()
+    if err != nil {
+        if exitErr, ok := err.(*exec.ExitError); ok {
+            return nil, fmt.Errorf("ffprobe failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+        }
+        return nil, err
+    }
+
+    var raw ffprobeOutput
+    if err := json.Unmarshal(output, &raw); err != nil {
+        return nil, fmt.Errorf("unreadable ffprobe output: %v", err)
+    }
+
+    probe := &models.ProbeResult{
+        Container:  raw.Format.FormatName,
+        FormatName: raw.Format.FormatLongName,
+        Duration:   parseFloat(raw.Format.Duration),
+        Size:       parseInt(raw.Format.Size),
+        BitRate:    parseInt(raw.Format.BitRate),
+        Streams:    make([]models.ProbeStream, 0, len(raw.Streams)),
+        Chapters:   make([]models.ProbeChapter, 0, len(raw.Chapters)),
+    }
+
+    for _, s := range raw.Streams {
+        stream := models.ProbeStream{
+            Index:          s.Index,
+            Type:           s.CodecType,
+            Codec:          s.CodecName,
+            Profile:        s.Profile,
+            BitRate:        parseInt(s.BitRate),
+            Duration:       parseFloat(s.Duration),
+            Language:       s.Tags["language"],
+            Title:          s.Tags["title"],
+            Default:        s.Disposition["default"] == 1,
+            Forced:         s.Disposition["forced"] == 1,
+            AttachedPic:    s.Disposition["attached_pic"] == 1,
+            Width:          s.Width,
+            Height:         s.Height,
+            PixelFormat:    s.PixFmt,
+            ColorSpace:     s.ColorSpace,
+            ColorTransfer:  s.ColorTransfer,
+            ColorPrimaries: s.ColorPrimaries,
+            ColorRange:     s.ColorRange,
+            SampleRate:     int(parseInt(s.SampleRate)),
+            Channels:       s.Channels,
+            ChannelLayout:  s.ChannelLayout,
+        }
+
+        if s.CodecType == "video" {
+            stream.FrameRate = parseRational(s.AvgFrameRate)
+            if stream.FrameRate == 0 {
+                stream.FrameRate = parseRational(s.RFrameRate)
+            }
+            stream.Rotation = streamRotation(s.Tags, s.SideDataList)
+            // "1:1" is square, "0:1" unknown; neither needs correcting
+            if sar := parseRational(strings.Replace(s.SampleAspect, ":", "/", 1)); sar > 0 && sar != 1 {
+                stream.SampleAspect = sar
+            }
+        }
+
+        probe.Streams = append(probe.Streams, stream)
+    }
+
+    for _, ch := range raw.Chapters {
+        probe.Chapters = append(probe.Chapters, models.ProbeChapter{
+            ID:    ch.ID,
+            Start: parseFloat(ch.StartTime),
+            End:   parseFloat(ch.EndTime),
+            Title: ch.Tags["title"],
+        })
+    }
+
+    return probe, nil
+}
+
+// streamRotation normalises rotation metadata to clockwise degrees. Older
+// files carry a rotate tag, newer ffprobe reports a display matrix whose
+// angle is counter-clockwise.
+func streamRotation(tags map[string]string, sideData []ffprobeSideData) int {
+    rotation := 0
+    if tag, ok := tags["rotate"]; ok {
+        rotation, _ = strconv.Atoi(tag)
+    }
+    for _, data := range sideData {
+        if data.SideDataType == "Display Matrix" {
+            rotation = int(-data.Rotation)
+        }
+    }
+    return ((rotation % 360) + 360) % 360
+}
+
+// displaySize is the size of the picture as a player shows it, with
+// non-square pixels stretched out and rotation metadata applied
+func displaySize(stream *models.ProbeStream) (width, height int) {
+    width, height = stream.Width, stream.Height
+    if stream.SampleAspect > 0 {
+        width = int(math.Round(float64(width) * stream.SampleAspect))
+    }
+    if stream.Rotation == 90 || stream.Rotation == 270 {
+        return height, width
+    }
+    return width, height
+}
+
+// parseRational turns ffprobe rates such as "30000/1001" into a float
+func parseRational(value string) float64 {
+    num, den, found := strings.Cut(value, "/")
+    if !found {
+        return parseFloat(value)
+    }
+    d := parseFloat(den)
+    if d == 0 {
+        return 0
+    }
+    return parseFloat(num) / d
+}
+
+func parseFloat(value string) float64 {
+    parsed, _ := strconv.ParseFloat(value, 64)
+    return parsed
+}
+
+func parseInt(value string) int64 {
+    parsed, _ := strconv.ParseInt(value, 10, 64)
+    return parsed
+}
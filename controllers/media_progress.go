@@ -0,0 +1,256 @@
+package controllers
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "log"
+    "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "task-automation-rig/models"
+)
+
+// ffmpegProgress is one block of ffmpeg's -progress output. Blocks are
+// key=value lines terminated by progress=continue or progress=end.
+type ffmpegProgress struct {
+    Frame       int64
+    FPS         float64
+    BitrateKbps float64
+    TotalSize   int64
+    OutTime     float64 // Seconds
+    Speed       float64
+    Done        bool
+}
+
+// overwrite makes ffmpeg replace existing outputs instead of refusing, so a
+// retry can write over what a failed run left behind
+func overwrite(args []string) []string {
+    return append([]string{"-y"}, args...)
+}
+
+// runFFmpeg runs ffmpeg and reports every progress block to onProgress. The
+// args must route -progress to pipe:1; stderr is logged as before.
+func runFFmpeg(args []string, onProgress func(ffmpegProgress)) error {
+    ffmpegSlots <- struct{}{}
+    defer func() { <-ffmpegSlots }()
+
+    args = overwrite(args)
+    cmd := exec.Command("ffmpeg", args...)
+    log.Printf("Executing command: ffmpeg %v\n", args)
+
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        log.Printf("Error creating stdout pipe: %v\n", err)
+        return err
+    }
+
+    stderr, err := cmd.StderrPipe()
+    if err != nil {
+        log.Printf("Error creating stderr pipe: %v\n", err)
+        return err
+    }
+
+    if err := cmd.Start(); err != nil {
+        log.Printf("Error starting FFmpeg: %v\n", err)
+        return err
+    }
+
+    // Both pipes have to be drained before Wait closes them
+    var readers sync.WaitGroup
+    readers.Add(2)
+
+    go func() {
+        defer readers.Done()
+        parseProgress(stdout, onProgress)
+    }()
+
+    go func() {
+        defer readers.Done()
+        scanner := bufio.NewScanner(stderr)
+        for scanner.Scan() {
+            log.Printf("FFmpeg output: %s\n", scanner.Text())
+        }
+    }()
+
+    readers.Wait()
+    if err := cmd.Wait(); err != nil {
+        log.Printf("FFmpeg command failed: %v\n", err)
+        return err
+    }
+    return nil
+}
+
+// runFFmpegOutput runs a short ffmpeg command to completion and returns its
+// combined output, which is where ffmpeg prints analysis results
+func runFFmpegOutput(args ...string) (string, error) {
+    ffmpegSlots <- struct{}{}
+    defer func() { <-ffmpegSlots }()
+
+    args = overwrite(args)
+    log.Printf("Executing command: ffmpeg %v\n", args)
+    output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+    if err != nil {
+        return string(output), fmt.Errorf("ffmpeg failed: %v. Output: %s", err, lastLines(string(output), 5))
+    }
+    return string(output), nil
+}
+
+// lastLines keeps error messages readable, ffmpeg prints its banner first
+func lastLines(output string, n int) string {
+    lines := strings.Split(strings.TrimSpace(output), "\n")
+    if len(lines) > n {
+        lines = lines[len(lines)-n:]
+    }
+    return strings.Join(lines, "\n")
+}
+
+func parseProgress(r io.Reader, onProgress func(ffmpegProgress)) {
+    var current ffmpegProgress
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+        if !found {
+            continue
+        }
+        value = strings.TrimSpace(value)
+
+        switch key {
+        case "frame":
+            current.Frame, _ = strconv.ParseInt(value, 10, 64)
+        case "fps":
+            current.FPS, _ = strconv.ParseFloat(value, 64)
+        case "bitrate":
+            // e.g. "1234.5kbits/s" or "N/A"
+            current.BitrateKbps, _ = strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64)
+        case "total_size":
+            current.TotalSize, _ = strconv.ParseInt(value, 10, 64)
+        case "out_time_us":
+            if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+                current.OutTime = float64(us) / 1e6
+            }
+        case "speed":
+            // e.g. "1.52x" or "N/A"
+            current.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+        case "progress":
+            current.Done = value == "end"
+            if onProgress != nil {
+                onProgress(current)
+            }
+        }
+    }
+}
+
+// updateRenditionProgress stores a progress block on the rendition being
+// encoded and refreshes the job totals.
+func updateRenditionProgress(job *models.MediaJob, file *models.MediaFile, rendition *models.RenditionOutput, p ffmpegProgress) {
+    job.Lock()
+    defer job.Unlock()
+
+    progress := &rendition.Progress
+    progress.Frame = p.Frame
+    progress.FPS = p.FPS
+    progress.Speed = p.Speed
+    progress.BitrateKbps = p.BitrateKbps
+    progress.OutputSize = p.TotalSize
+    progress.OutTime = p.OutTime
+
+    if file.Duration > 0 {
+        progress.Percent = clampPercent(p.OutTime / file.Duration * 100)
+        if p.Speed > 0 {
+            progress.ETA = (file.Duration - p.OutTime) / p.Speed
+            if progress.ETA < 0 {
+                progress.ETA = 0
+            }
+        }
+    }
+    if p.Done {
+        progress.Percent = 100
+        progress.ETA = 0
+    }
+
+    rollUpProgress(job, rendition)
+}
+
+// setRenditionStatus moves a rendition on and refreshes the job totals. A
+// completed rendition is done whatever ffmpeg last reported.
+func setRenditionStatus(job *models.MediaJob, rendition *models.RenditionOutput, status string) {
+    job.Lock()
+    defer job.Unlock()
+
+    rendition.Status = status
+    if status == "completed" {
+        rendition.Progress.Percent = 100
+        rendition.Progress.ETA = 0
+    }
+    rollUpProgress(job, rendition)
+}
+
+// failRendition marks a rendition failed with the error that stopped it
+func failRendition(job *models.MediaJob, rendition *models.RenditionOutput, err error) {
+    job.Lock()
+    defer job.Unlock()
+
+    rendition.Status = "failed"
+    rendition.Error = err.Error()
+    rollUpProgress(job, rendition)
+}
+
+// updateJobProgress refreshes the job totals, current names the rendition
+// being encoded if any
+func updateJobProgress(job *models.MediaJob, current *models.RenditionOutput) {
+    job.Lock()
+    defer job.Unlock()
+    rollUpProgress(job, current)
+}
+
+// rollUpProgress rolls every rendition of every file up into the job.
+// Renditions are weighted by their source duration, so a long file counts
+// for more than a short one. Callers hold the job lock.
+func rollUpProgress(job *models.MediaJob, current *models.RenditionOutput) {
+    var totalWeight, doneWeight, outputSize float64
+    for _, file := range job.Files {
+        weight := file.Duration
+        if weight <= 0 {
+            weight = 1
+        }
+        for _, rendition := range file.Renditions {
+            if rendition.Status == "skipped" {
+                continue
+            }
+            totalWeight += weight
+            doneWeight += weight * rendition.Progress.Percent / 100
+            outputSize += float64(rendition.Progress.OutputSize)
+        }
+    }
+
+    progress := &job.Progress
+    progress.OutputSize = int64(outputSize)
+    if totalWeight > 0 {
+        progress.Percent = clampPercent(doneWeight / totalWeight * 100)
+    }
+
+    if current != nil {
+        progress.CurrentResolution = current.Resolution
+        progress.Frame = current.Progress.Frame
+        progress.FPS = current.Progress.FPS
+        progress.Speed = current.Progress.Speed
+        progress.BitrateKbps = current.Progress.BitrateKbps
+        progress.OutTime = current.Progress.OutTime
+        if current.Progress.Speed > 0 {
+            // Weights are seconds of media whenever durations are known
+            progress.ETA = (totalWeight - doneWeight) / current.Progress.Speed
+        }
+    }
+}
+
+func clampPercent(percent float64) float64 {
+    if percent < 0 {
+        return 0
+    }
+    if percent > 100 {
+        return 100
+    }
+    return percent
+}
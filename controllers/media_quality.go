@@ -0,0 +1,186 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "os/exec"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "task-automation-rig/models"
+)
+
+var (
+    ssimScore = regexp.MustCompile(`SSIM .*All:([0-9.]+)`)
+    psnrScore = regexp.MustCompile(`PSNR .*average:([0-9.]+|inf)`)
+    vmafScore = regexp.MustCompile(`VMAF score[:=]\s*([0-9.]+)`)
+)
+
+var (
+    libvmafOnce      sync.Once
+    libvmafAvailable bool
+)
+
+// validateQualityOptions checks the minimum scores
+func validateQualityOptions(request *models.MediaRequest) error {
+    opts := request.Quality
+    if opts == nil {
+        return nil
+    }
+    if opts.MinSSIM < 0 || opts.MinSSIM > 1 {
+        return fmt.Errorf("minimum SSIM must be between 0 and 1")
+    }
+    if opts.MinPSNR < 0 || opts.MinPSNR > 100 {
+        return fmt.Errorf("minimum PSNR must be between 0 and 100 dB")
+    }
+    if opts.MinVMAF < 0 || opts.MinVMAF > 100 {
+        return fmt.Errorf("minimum VMAF must be between 0 and 100")
+    }
+    if opts.MinVMAF > 0 {
+        // A threshold that can never be measured would never be enforced
+        if !hasLibvmaf() {
+            return fmt.Errorf("minimum VMAF needs an ffmpeg built with libvmaf")
+        }
+        opts.VMAF = true
+    }
+    return nil
+}
+
+// hasLibvmaf reports whether the ffmpeg build includes the libvmaf filter
+func hasLibvmaf() bool {
+    libvmafOnce.Do(func() {
+        output, err := exec.Command("ffmpeg", "-hide_banner", "-filters").Output()
+        libvmafAvailable = err == nil && strings.Contains(string(output), " libvmaf ")
+    })
+    return libvmafAvailable
+}
+
+// measureQuality scores a finished rendition against its source. The source
+// goes through the same filter graph as the encode, so the scores reflect
+// what the encoder lost rather than what the filters changed. variant picks
+// the video stream of a DASH manifest, which holds every rendition.
+func measureQuality(job *models.MediaJob, file *models.MediaFile, rendition *models.RenditionOutput, variant int) error {
+    opts := job.Quality
+    plan, err := renditionScale(job, file, rendition.Resolution)
+    if err != nil {
+        return err
+    }
+    chain := plan.filter
+    burnFilter, err := subtitleBurnFilter(job, file)
+    if err != nil {
+        return err
+    }
+    if burnFilter != "" {
+        chain = burnFilter + "," + chain
+    }
+    if steps := videoStepChain(job.Filters, file.Duration, true); steps != "" {
+        chain = steps + "," + chain
+    }
+
+    vmaf := opts.VMAF && hasLibvmaf()
+    if opts.VMAF && !vmaf {
+        log.Printf("ffmpeg has no libvmaf, skipping VMAF for %s\n", rendition.OutputPath)
+    }
+    metrics := []string{"ssim", "psnr"}
+    if vmaf {
+        metrics = append(metrics, "libvmaf")
+    }
+
+    // The source and watermark images keep their input numbers, the
+    // rendition comes last
+    args := append([]string{"-hide_banner"}, inputArgs(file)...)
+    args = append(args, watermarkInputs(job.Filters)...)
+    distorted := 1 + len(watermarkInputs(job.Filters))/2
+    args = append(args, "-i", rendition.OutputPath)
+
+    distortedPad := fmt.Sprintf("%d:v:0", distorted)
+    if job.OutputMode == models.OutputDASH {
+        distortedPad = fmt.Sprintf("%d:v:%d", distorted, variant)
+    }
+
+    // Both sides start at zero in the same pixel format so frames pair up
+    graph := []string{
+        buildFilterString(job.Filters, chain, videoInputPad(file), "ref"),
+        fmt.Sprintf("[ref]setpts=PTS-STARTPTS,format=yuv420p,split=%d%s", len(metrics), padList("r", len(metrics))),
+        fmt.Sprintf("[%s]setpts=PTS-STARTPTS,format=yuv420p,split=%d%s", distortedPad, len(metrics), padList("d", len(metrics))),
+    }
+    for i, metric := range metrics {
+        // The distorted stream goes first, libvmaf expects it there
+        graph = append(graph, fmt.Sprintf("[d%d][r%d]%s", i, i, metric))
+    }
+    args = append(args, "-filter_complex", strings.Join(graph, ";"), "-an", "-sn", "-f", "null", "-")
+
+    log.Printf("Measuring quality of %s\n", rendition.OutputPath)
+    output, err := runFFmpegOutput(args...)
+    if err != nil {
+        return fmt.Errorf("quality measurement failed: %v", err)
+    }
+
+    scores, err := parseQualityScores(output, vmaf)
+    if err != nil {
+        return err
+    }
+    job.Lock()
+    rendition.Quality = scores
+    job.Unlock()
+    log.Printf("Quality of %s: SSIM %.4f, PSNR %.2f dB\n", rendition.OutputPath, scores.SSIM, scores.PSNR)
+
+    if opts.MinSSIM > 0 && scores.SSIM < opts.MinSSIM {
+        return fmt.Errorf("%s rendition of %s has SSIM %.4f, below the minimum of %.4f",
+            rendition.Resolution, file.Path, scores.SSIM, opts.MinSSIM)
+    }
+    if opts.MinPSNR > 0 && scores.PSNR < opts.MinPSNR {
+        return fmt.Errorf("%s rendition of %s has PSNR %.2f dB, below the minimum of %.2f dB",
+            rendition.Resolution, file.Path, scores.PSNR, opts.MinPSNR)
+    }
+    if opts.MinVMAF > 0 && scores.VMAF == nil {
+        return fmt.Errorf("%s rendition of %s has no VMAF score to check against the minimum", rendition.Resolution, file.Path)
+    }
+    if opts.MinVMAF > 0 && *scores.VMAF < opts.MinVMAF {
+        return fmt.Errorf("%s rendition of %s has VMAF %.2f, below the minimum of %.2f",
+            rendition.Resolution, file.Path, *scores.VMAF, opts.MinVMAF)
+    }
+    return nil
+}
+
+// parseQualityScores reads the summaries the metric filters log at the end
+func parseQualityScores(output string, vmaf bool) (*models.QualityScores, error) {
+    scores := &models.QualityScores{}
+
+    m := ssimScore.FindAllStringSubmatch(output, -1)
+    if m == nil {
+        return nil, fmt.Errorf("no SSIM score in ffmpeg output")
+    }
+    scores.SSIM, _ = strconv.ParseFloat(m[len(m)-1][1], 64)
+
+    m = psnrScore.FindAllStringSubmatch(output, -1)
+    if m == nil {
+        return nil, fmt.Errorf("no PSNR score in ffmpeg output")
+    }
+    scores.PSNR, _ = strconv.ParseFloat(m[len(m)-1][1], 64)
+    // Identical frames have infinite PSNR, which JSON cannot carry
+    if math.IsInf(scores.PSNR, 0) || scores.PSNR > 100 {
+        scores.PSNR = 100
+    }
+
+    if vmaf {
+        m = vmafScore.FindAllStringSubmatch(output, -1)
+        if m == nil {
+            return nil, fmt.Errorf("no VMAF score in ffmpeg output")
+        }
+        score, _ := strconv.ParseFloat(m[len(m)-1][1], 64)
+        scores.VMAF = &score
+    }
+    return scores, nil
+}
+
+// padList names n filter pads prefix0 to prefixN-1
+func padList(prefix string, n int) string {
+    var pads strings.Builder
+    for i := 0; i < n; i++ {
+        pads.WriteString(fmt.Sprintf("[%s%d]", prefix, i))
+    }
+    return pads.String()
+}
@@ -0,0 +1,191 @@
+package controllers
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "task-automation-rig/models"
+)
+
+// videoRate is the resolved rate control for one encode
+type videoRate struct {
+    crf         int
+    bitrateKbps int
+    maxRateKbps int
+    bufSizeKbps int
+    twoPass     bool
+}
+
+// validateRateControl checks the rate control block and fills in defaults
+func validateRateControl(request *models.MediaRequest) error {
+    rc := request.RateControl
+    if rc == nil {
+        return nil
+    }
+
+    switch rc.Mode {
+    case "", models.RateCRF:
+        rc.Mode = models.RateCRF
+        maxCRF := 51
+        if request.CodecType == models.VP9 || request.CodecType == models.AV1 {
+            maxCRF = 63
+        }
+        if rc.CRF != nil && (*rc.CRF < 0 || *rc.CRF > maxCRF) {
+            return fmt.Errorf("crf for %s must be between 0 and %d", request.CodecType, maxCRF)
+        }
+    case models.RateBitrate:
+        if rc.BitrateKbps <= 0 {
+            return fmt.Errorf("bitrate mode needs bitrateKbps")
+        }
+        if rc.MaxRateKbps != 0 && rc.MaxRateKbps < rc.BitrateKbps {
+            return fmt.Errorf("maxRateKbps must not be below bitrateKbps")
+        }
+        if rc.BufSizeKbps < 0 || (rc.BufSizeKbps > 0 && rc.MaxRateKbps == 0) {
+            return fmt.Errorf("bufSizeKbps needs maxRateKbps")
+        }
+        if rc.MaxRateKbps > 0 && rc.BufSizeKbps == 0 {
+            rc.BufSizeKbps = rc.MaxRateKbps * 2
+        }
+    case models.RateTargetSize:
+        if rc.TargetSizeMB <= 0 {
+            return fmt.Errorf("targetSize mode needs targetSizeMB")
+        }
+    default:
+        return fmt.Errorf("unsupported rate control mode: %s", rc.Mode)
+    }
+
+    // Adaptive ladders size every rendition themselves
+    if request.OutputMode != models.OutputFiles && rc.Mode != models.RateCRF {
+        return fmt.Errorf("%s output only supports crf rate control", request.OutputMode)
+    }
+
+    return nil
+}
+
+// resolveVideoRate turns the job's rate control into concrete settings for
+// one source. targetSize derives the bitrate from the probed duration,
+// leaving room for the audio track and container overhead.
+func resolveVideoRate(job *models.MediaJob, file *models.MediaFile) (videoRate, error) {
+    rate := videoRate{crf: defaultCRF(job.CodecType)}
+    rc := job.RateControl
+    if rc == nil {
+        return rate, nil
+    }
+
+    switch rc.Mode {
+    case models.RateBitrate:
+        rate.bitrateKbps = rc.BitrateKbps
+        rate.maxRateKbps = rc.MaxRateKbps
+        rate.bufSizeKbps = rc.BufSizeKbps
+    case models.RateTargetSize:
+        if file.Duration <= 0 {
+            return rate, fmt.Errorf("target size needs a known source duration")
+        }
+        // 1 MB = 8000 kbit, keep 2% back for muxing overhead
+        totalKbps := rc.TargetSizeMB * 8000 * 0.98 / file.Duration
+        audioKbps, err := estimateAudioKbps(job, file)
+        if err != nil {
+            return rate, err
+        }
+        videoKbps := int(totalKbps) - audioKbps
+        if videoKbps < 50 {
+            return rate, fmt.Errorf("target size of %.1f MB is too small for %.0f seconds of video", rc.TargetSizeMB, file.Duration)
+        }
+        rate.bitrateKbps = videoKbps
+        rate.twoPass = true
+    default:
+        if rc.CRF != nil {
+            rate.crf = *rc.CRF
+        }
+    }
+    return rate, nil
+}
+
+// estimateAudioKbps is the audio share of a size budget, summed over every
+// audio track the job keeps
+func estimateAudioKbps(job *models.MediaJob, file *models.MediaFile) (int, error) {
+    tracks, err := selectAudioTracks(job, file)
+    if err != nil {
+        return 0, err
+    }
+
+    codec := resolveAudioCodec(job, file)
+    total := 0
+    for _, track := range tracks {
+        if codec == models.AudioCopy {
+            if track.bitRate > 0 {
+                total += int(track.bitRate / 1000)
+            } else {
+                total += 192
+            }
+            continue
+        }
+        total += encodedAudioKbps(job, codec)
+    }
+    return total, nil
+}
+
+// encodedAudioKbps is the bitrate of one re-encoded audio track
+func encodedAudioKbps(job *models.MediaJob, codec models.AudioCodec) int {
+    bitrate := defaultAudioBitrate(codec)
+    if job.Audio != nil && job.Audio.Bitrate != "" {
+        bitrate = job.Audio.Bitrate
+    }
+    if bitrate == "" {
+        // Lossless FLAC, a generous guess
+        return 700
+    }
+    if strings.HasSuffix(bitrate, "k") {
+        kbps, _ := strconv.Atoi(strings.TrimSuffix(bitrate, "k"))
+        return kbps
+    }
+    bps, _ := strconv.Atoi(bitrate)
+    return bps / 1000
+}
+
+func defaultCRF(codecType models.CodecType) int {
+    switch codecType {
+    case models.VP9:
+        return 31
+    case models.H265:
+        return 28
+    case models.AV1:
+        return 30
+    default: // H264
+        return 23
+    }
+}
+
+// videoCodecArgs selects the encoder and its rate control. Extra x265
+// parameters are merged into the single -x265-params the encoder accepts.
+func videoCodecArgs(codecType models.CodecType, rate videoRate, x265Params ...string) []string {
+    args := []string{"-c:v", getFFmpegCodec(codecType)}
+
+    if rate.bitrateKbps > 0 {
+        args = append(args, "-b:v", fmt.Sprintf("%dk", rate.bitrateKbps))
+        if rate.maxRateKbps > 0 {
+            args = append(args,
+                "-maxrate", fmt.Sprintf("%dk", rate.maxRateKbps),
+                "-bufsize", fmt.Sprintf("%dk", rate.bufSizeKbps))
+        }
+    } else {
+        if codecType == models.VP9 {
+            // libvpx only runs in constant quality mode with a zero bitrate
+            args = append(args, "-b:v", "0")
+        }
+        args = append(args, "-crf", strconv.Itoa(rate.crf))
+    }
+
+    switch codecType {
+    case models.VP9:
+        args = append(args, "-deadline", "good", "-cpu-used", "4")
+    case models.H265:
+        params := append([]string{"log-level=error"}, x265Params...)
+        args = append(args, "-preset", "medium", "-x265-params", strings.Join(params, ":"))
+    case models.AV1:
+        args = append(args, "-strict", "experimental", "-cpu-used", "4")
+    default: // H264
+        args = append(args, "-preset", "medium")
+    }
+    return args
+}
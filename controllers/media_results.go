@@ -0,0 +1,220 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "github.com/gofiber/fiber/v2"
+    "task-automation-rig/models"
+)
+
+// RetryMediaJob re-queues a finished job to re-run only its failed files
+// and renditions. Completed outputs are left as they are.
+func (c *MediaController) RetryMediaJob(ctx *fiber.Ctx) error {
+    id := ctx.Params("id")
+    c.mu.Lock()
+    job, exists := c.jobs[id]
+    if !exists {
+        c.mu.Unlock()
+        return ctx.Status(fiber.StatusNotFound).JSON(fiber.Map{
+            "error": "Job not found",
+        })
+    }
+    job.Lock()
+    status := job.Status
+    if status != "failed" && status != "completed_with_errors" {
+        job.Unlock()
+        c.mu.Unlock()
+        return ctx.Status(fiber.StatusConflict).JSON(fiber.Map{
+            "error": fmt.Sprintf("Only failed jobs can be retried, job is %s", status),
+        })
+    }
+    resetFailedItems(job)
+    job.Unlock()
+    c.mu.Unlock()
+
+    log.Printf("Retrying media job %s (retry %d)\n", job.ID, job.Retries)
+    c.scheduler.submit(mediaJobs, job.ID, func() { c.processMediaJob(job) })
+
+    job.Lock()
+    defer job.Unlock()
+    return ctx.Status(fiber.StatusAccepted).JSON(c.jobView(job))
+}
+
+// resetFailedItems puts the failed files and renditions of a job back to
+// pending. Files that never started are pending already. Callers hold the
+// job lock.
+func resetFailedItems(job *models.MediaJob) {
+    adaptive := job.OutputMode == models.OutputHLS || job.OutputMode == models.OutputDASH
+    for _, file := range job.Files {
+        if file.Status != "failed" && file.Status != "in_progress" {
+            continue
+        }
+        file.Status = "pending"
+        file.Error = ""
+        // Previews and subtitles are written again after the renditions
+        file.Previews = nil
+        file.SubtitleFiles = nil
+
+        for _, rendition := range file.Renditions {
+            if rendition.Status == "skipped" {
+                continue
+            }
+            if rendition.Status == "completed" && !adaptive {
+                continue
+            }
+            rendition.Status = "pending"
+            rendition.Error = ""
+            rendition.Size = 0
+            rendition.Duration = 0
+            rendition.Quality = nil
+            rendition.Progress = models.EncodeProgress{}
+        }
+    }
+
+    job.Status = "queued"
+    job.Error = ""
+    job.Results = nil
+    job.EndTime = time.Time{}
+    job.Retries++
+    rollUpProgress(job, nil)
+}
+
+// failedMediaFile stands in for a source that could not be read or laid
+// out. It has no renditions until a retry lays it out again.
+func failedMediaFile(path string, err error) *models.MediaFile {
+    base := filepath.Base(path)
+    return &models.MediaFile{
+        Path:   path,
+        Name:   strings.TrimSuffix(base, filepath.Ext(base)),
+        Status: "failed",
+        Error:  err.Error(),
+    }
+}
+
+// layoutFailedFiles lays out the sources a retry put back to pending
+// without ever having laid them out. A source with clips may turn into
+// several files.
+func (c *MediaController) layoutFailedFiles(job *models.MediaJob) error {
+    var files []*models.MediaFile
+    for _, file := range job.Files {
+        if file.Renditions != nil || file.Status != "pending" {
+            files = append(files, file)
+            continue
+        }
+
+        laidOut, err := c.newMediaFiles(job, file.Path)
+        if err != nil {
+            if !job.ContinueOnError {
+                return err
+            }
+            log.Printf("Skipping %s: %v\n", file.Path, err)
+            job.Lock()
+            file.Status = "failed"
+            file.Error = err.Error()
+            job.Unlock()
+            files = append(files, file)
+            continue
+        }
+        files = append(files, laidOut...)
+    }
+    job.Lock()
+    job.Files = files
+    job.Unlock()
+    return nil
+}
+
+// recordOutputs notes the size and duration of every finished rendition of
+// a file and carries the file's error onto renditions that stopped without
+// one of their own. Outputs are measured before the job lock is taken.
+func recordOutputs(job *models.MediaJob, file *models.MediaFile, err error) {
+    for _, rendition := range file.Renditions {
+        var size int64
+        var duration float64
+        if rendition.Status == "completed" && rendition.Duration == 0 && rendition.OutputPath != "" {
+            size = outputSize(rendition.OutputPath)
+            if probe, probeErr := probeMedia(rendition.OutputPath); probeErr == nil {
+                duration = probe.Duration
+            }
+        }
+
+        job.Lock()
+        switch rendition.Status {
+        case "in_progress":
+            if err != nil {
+                rendition.Status = "failed"
+            }
+        case "completed":
+            if rendition.Duration == 0 {
+                rendition.Size, rendition.Duration = size, duration
+            }
+        }
+        if rendition.Status == "failed" && rendition.Error == "" && err != nil {
+            rendition.Error = err.Error()
+        }
+        job.Unlock()
+    }
+}
+
+// outputSize is the size of an output file. An HLS variant playlist counts
+// its whole directory, segments included; a DASH manifest is shared by
+// every rendition and is not attributed to any.
+func outputSize(path string) int64 {
+    switch filepath.Ext(path) {
+    case ".mpd":
+        return 0
+    case ".m3u8":
+        var size int64
+        entries, err := os.ReadDir(filepath.Dir(path))
+        if err != nil {
+            return 0
+        }
+        for _, entry := range entries {
+            if info, err := entry.Info(); err == nil && !info.IsDir() {
+                size += info.Size()
+            }
+        }
+        return size
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        return 0
+    }
+    return info.Size()
+}
+
+// mediaResults flattens the files of a job into one line per rendition
+func mediaResults(job *models.MediaJob) []models.MediaResult {
+    var results []models.MediaResult
+    for _, file := range job.Files {
+        renditionFailed := false
+        for _, rendition := range file.Renditions {
+            results = append(results, models.MediaResult{
+                File:       file.Path,
+                Name:       file.Name,
+                Resolution: rendition.Resolution,
+                Status:     rendition.Status,
+                OutputPath: rendition.OutputPath,
+                Size:       rendition.Size,
+                Duration:   rendition.Duration,
+                Error:      rendition.Error,
+            })
+            if rendition.Status == "failed" {
+                renditionFailed = true
+            }
+        }
+        // Failures outside the renditions still need a line of their own
+        if file.Status == "failed" && !renditionFailed {
+            results = append(results, models.MediaResult{
+                File:   file.Path,
+                Name:   file.Name,
+                Status: file.Status,
+                Error:  file.Error,
+            })
+        }
+    }
+    return results
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+    "fmt"
+    "math"
+    "task-automation-rig/models"
+)
+
+// scalePlan is how one rendition resizes its source
+type scalePlan struct {
+    width   int    // Output frame width, 0 when the source size is unknown
+    height  int    // Output frame height
+    filter  string // Scale chain, including any crop or pad
+    upscale bool   // The picture would be enlarged beyond the source
+}
+
+// planScale works out the output size of a rendition. With a probed source
+// the exact size is computed here, keeping the display aspect ratio and
+// rounding to even dimensions; without one ffmpeg is left to do the same
+// from expressions.
+func planScale(resolution models.Resolution, mode models.ScaleMode, source *models.ProbeStream) (scalePlan, error) {
+    boxWidth, boxHeight, err := resolution.Dimensions()
+    if err != nil {
+        return scalePlan{}, err
+    }
+
+    // Odd boxes would leave odd crops and pads
+    if boxWidth > 0 {
+        boxWidth = evenRound(float64(boxWidth))
+    }
+    boxHeight = evenRound(float64(boxHeight))
+
+    if source == nil || source.Width == 0 || source.Height == 0 {
+        return expressionScale(boxWidth, boxHeight, mode), nil
+    }
+
+    srcWidth, srcHeight := displaySize(source)
+
+    // Presets describe 16:9 boxes; turn them on their side for portrait
+    // sources so 1080p of a phone video stays 1080 pixels wide
+    if resolution.IsPreset() && srcHeight > srcWidth {
+        boxWidth, boxHeight = boxHeight, boxWidth
+    }
+
+    // Height-only resolutions follow the source aspect ratio exactly
+    if boxWidth == 0 {
+        width := evenRound(float64(srcWidth) * float64(boxHeight) / float64(srcHeight))
+        return scalePlan{
+            width:   width,
+            height:  boxHeight,
+            filter:  fmt.Sprintf("scale=%d:%d,setsar=1", width, boxHeight),
+            upscale: boxHeight > srcHeight,
+        }, nil
+    }
+
+    fitFactor := math.Min(float64(boxWidth)/float64(srcWidth), float64(boxHeight)/float64(srcHeight))
+    fillFactor := math.Max(float64(boxWidth)/float64(srcWidth), float64(boxHeight)/float64(srcHeight))
+
+    switch mode {
+    case models.ScaleFill:
+        width := evenRound(float64(srcWidth) * fillFactor)
+        height := evenRound(float64(srcHeight) * fillFactor)
+        return scalePlan{
+            width:   boxWidth,
+            height:  boxHeight,
+            filter:  fmt.Sprintf("scale=%d:%d,crop=%d:%d,setsar=1", width, height, boxWidth, boxHeight),
+            upscale: height > srcHeight,
+        }, nil
+    case models.ScalePad:
+        width := evenRound(float64(srcWidth) * fitFactor)
+        height := evenRound(float64(srcHeight) * fitFactor)
+        return scalePlan{
+            width:  boxWidth,
+            height: boxHeight,
+            filter: fmt.Sprintf("scale=%d:%d,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1",
+                width, height, boxWidth, boxHeight),
+            upscale: height > srcHeight,
+        }, nil
+    default: // Fit
+        width := evenRound(float64(srcWidth) * fitFactor)
+        height := evenRound(float64(srcHeight) * fitFactor)
+        return scalePlan{
+            width:   width,
+            height:  height,
+            filter:  fmt.Sprintf("scale=%d:%d,setsar=1", width, height),
+            upscale: height > srcHeight,
+        }, nil
+    }
+}
+
+// expressionScale is the fallback for sources ffprobe could not size
+func expressionScale(boxWidth, boxHeight int, mode models.ScaleMode) scalePlan {
+    if boxWidth == 0 {
+        return scalePlan{height: boxHeight, filter: fmt.Sprintf("scale=-2:%d,setsar=1", boxHeight)}
+    }
+
+    var filter string
+    switch mode {
+    case models.ScaleFill:
+        filter = fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,setsar=1",
+            boxWidth, boxHeight, boxWidth, boxHeight)
+    case models.ScalePad:
+        filter = fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease:force_divisible_by=2,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1",
+            boxWidth, boxHeight, boxWidth, boxHeight)
+    default: // Fit
+        filter = fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease:force_divisible_by=2,setsar=1",
+            boxWidth, boxHeight)
+    }
+    return scalePlan{width: boxWidth, height: boxHeight, filter: filter}
+}
+
+// renditionScale plans the scale of a rendition of the given file
+func renditionScale(job *models.MediaJob, file *models.MediaFile, resolution models.Resolution) (scalePlan, error) {
+    var source *models.ProbeStream
+    if file.Probe != nil {
+        source = filteredSource(job.Filters, file.Probe.VideoStream())
+    }
+    return planScale(resolution, job.ScaleMode, source)
+}
+
+// evenRound rounds to the nearest even number, most encoders reject odd
+// dimensions with 4:2:0 chroma
+func evenRound(value float64) int {
+    even := int(math.Round(value/2)) * 2
+    if even < 2 {
+        return 2
+    }
+    return even
+}
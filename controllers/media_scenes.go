@@ -0,0 +1,190 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "task-automation-rig/models"
+)
+
+var showinfoTime = regexp.MustCompile(`pts_time:\s*([0-9.]+)`)
+
+// validateSceneOptions checks the scene block and fills in its defaults
+func validateSceneOptions(request *models.MediaRequest) error {
+    opts := request.Scenes
+    if opts == nil {
+        return nil
+    }
+    if opts.Threshold == 0 {
+        opts.Threshold = 0.4
+    }
+    if opts.MinDuration == 0 {
+        opts.MinDuration = 10
+    }
+    if opts.Threshold < 0 || opts.Threshold > 1 {
+        return fmt.Errorf("scene threshold must be between 0 and 1")
+    }
+    if opts.MinDuration < 0 {
+        return fmt.Errorf("minimum scene duration must be positive")
+    }
+    return nil
+}
+
+// detectScenes scores every frame against the one before it and turns the
+// cuts above the threshold into scenes. Frames are scaled down first, the
+// score does not need detail and the analysis runs several times faster.
+func detectScenes(job *models.MediaJob, file *models.MediaFile) error {
+    if file.Duration <= 0 {
+        return fmt.Errorf("scene detection needs a known duration")
+    }
+    log.Printf("Detecting scenes in: %s\n", file.Path)
+
+    cuts, err := findSceneCuts(file, job.Scenes.Threshold)
+    if err != nil {
+        return err
+    }
+
+    scenes := buildScenes(cuts, file.Duration, job.Scenes.MinDuration)
+    job.Lock()
+    file.Scenes = scenes
+    job.Unlock()
+    log.Printf("Found %d scenes in %s\n", len(scenes), file.Path)
+    return nil
+}
+
+// findSceneCuts returns the times of the frames scoring above threshold
+func findSceneCuts(file *models.MediaFile, threshold float64) ([]float64, error) {
+    args := append(inputArgs(file), "-map", videoInputPad(file), "-an", "-sn",
+        "-vf", fmt.Sprintf("scale=320:-2,select='gt(scene,%g)',showinfo", threshold),
+        "-f", "null", "-")
+    output, err := runFFmpegOutput(args...)
+    if err != nil {
+        return nil, fmt.Errorf("scene detection failed: %v", err)
+    }
+
+    var cuts []float64
+    for _, line := range strings.Split(output, "\n") {
+        if !strings.Contains(line, "Parsed_showinfo") {
+            continue
+        }
+        if m := showinfoTime.FindStringSubmatch(line); m != nil {
+            if t, err := strconv.ParseFloat(m[1], 64); err == nil {
+                cuts = append(cuts, t)
+            }
+        }
+    }
+    return cuts, nil
+}
+
+// buildScenes turns cut times into consecutive scenes covering the whole
+// file, dropping cuts that would leave a scene shorter than minDuration
+func buildScenes(cuts []float64, duration, minDuration float64) []models.Scene {
+    sort.Float64s(cuts)
+
+    starts := []float64{0}
+    for _, cut := range cuts {
+        if cut-starts[len(starts)-1] >= minDuration && duration-cut >= minDuration {
+            starts = append(starts, cut)
+        }
+    }
+
+    scenes := make([]models.Scene, len(starts))
+    for i, start := range starts {
+        end := duration
+        if i+1 < len(starts) {
+            end = starts[i+1]
+        }
+        scenes[i] = models.Scene{Index: i + 1, Start: start, End: end}
+    }
+    return scenes
+}
+
+// chapterFile writes the scenes of a file as FFMETADATA chapters into dir
+// and returns the path, empty when the output cannot carry chapters
+func chapterFile(job *models.MediaJob, file *models.MediaFile, dir string) (string, error) {
+    if len(file.Scenes) < 2 || job.OutputMode != models.OutputFiles ||
+        (job.ContainerFormat != models.MP4 && job.ContainerFormat != models.MKV) {
+        return "", nil
+    }
+
+    var meta strings.Builder
+    meta.WriteString(";FFMETADATA1\n")
+    for _, scene := range file.Scenes {
+        meta.WriteString(fmt.Sprintf("\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=Chapter %d\n",
+            int64(scene.Start*1000), int64(scene.End*1000), scene.Index))
+    }
+
+    path := filepath.Join(dir, "chapters.txt")
+    if err := os.WriteFile(path, []byte(meta.String()), 0644); err != nil {
+        return "", fmt.Errorf("failed to write chapters: %v", err)
+    }
+    return path, nil
+}
+
+// chapterArgs reads the chapters from the metadata input, which follows the
+// source and the watermark images
+func chapterArgs(filters *models.VideoFilter, chapters string) (input, output []string) {
+    if chapters == "" {
+        return nil, nil
+    }
+    index := 1 + len(watermarkInputs(filters))/2
+    return []string{"-f", "ffmetadata", "-i", chapters}, []string{"-map_chapters", strconv.Itoa(index)}
+}
+
+// splitScenes cuts a file into one file per scene with the segment muxer.
+// Streams are copied, so every cut lands on the first keyframe at or after
+// the scene start.
+func splitScenes(job *models.MediaJob, file *models.MediaFile) error {
+    if len(file.Scenes) == 0 {
+        return nil
+    }
+    log.Printf("Splitting %s into %d scenes\n", file.Path, len(file.Scenes))
+
+    ext := copyExtension(file.Path, file.Probe)
+    pattern, err := safeJoin(job.DestinationPath, file.Name+"_scene%03d"+ext)
+    if err != nil {
+        return err
+    }
+
+    var times []string
+    for _, scene := range file.Scenes[1:] {
+        times = append(times, formatSeconds(scene.Start))
+    }
+    maps, err := copyMapArgs(job, file)
+    if err != nil {
+        return err
+    }
+    args := append(inputArgs(file), maps...)
+    args = append(args, "-c", "copy", "-f", "segment",
+        "-segment_start_number", "1", "-reset_timestamps", "1")
+    if len(times) > 0 {
+        args = append(args, "-segment_times", strings.Join(times, ","))
+    } else {
+        // A single scene still becomes a single file
+        args = append(args, "-segment_time", formatSeconds(file.Duration+1))
+    }
+    if _, err := runFFmpegOutput(append(args, pattern)...); err != nil {
+        return fmt.Errorf("failed to split scenes: %v", err)
+    }
+
+    paths := make([]string, len(file.Scenes))
+    for i := range file.Scenes {
+        path, err := safeJoin(job.DestinationPath,
+            fmt.Sprintf("%s_scene%03d%s", file.Name, file.Scenes[i].Index, ext))
+        if err != nil {
+            return err
+        }
+        paths[i] = path
+    }
+    job.Lock()
+    for i := range file.Scenes {
+        file.Scenes[i].Path = paths[i]
+    }
+    job.Unlock()
+    return nil
+}
@@ -0,0 +1,210 @@
+package controllers
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+    "task-automation-rig/models"
+)
+
+var (
+    languageCode  = regexp.MustCompile(`^[a-z]{2,3}$`)
+    trackNameChar = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+)
+
+// audioTrack is a source audio track resolved for one file
+type audioTrack struct {
+    spec     string // Map specifier on input 0
+    codec    string // Source codec, empty without a probe
+    bitRate  int64  // Source bits per second, 0 when unknown
+    language string
+    title    string
+    def      bool
+    forced   bool
+}
+
+// validateStreamOptions checks the stream selection
+func validateStreamOptions(request *models.MediaRequest) error {
+    opts := request.Streams
+    if opts == nil {
+        return nil
+    }
+    if len(opts.Audio) > 16 {
+        return fmt.Errorf("at most 16 audio tracks per job")
+    }
+
+    defaults := 0
+    for i := range opts.Audio {
+        track := &opts.Audio[i]
+        track.Language = strings.ToLower(track.Language)
+        if (track.Language == "") == (track.Index == nil) {
+            return fmt.Errorf("audio track %d needs either a language or an index", i+1)
+        }
+        if track.Language != "" && !languageCode.MatchString(track.Language) {
+            return fmt.Errorf("audio track %d: %s is not an ISO 639 language code", i+1, track.Language)
+        }
+        if track.Index != nil && *track.Index < 0 {
+            return fmt.Errorf("audio track %d: index must be positive", i+1)
+        }
+        if track.Default {
+            defaults++
+        }
+    }
+    if defaults > 1 {
+        return fmt.Errorf("only one audio track can be the default")
+    }
+
+    if len(opts.Audio) > 1 && request.Audio != nil && request.Audio.Loudnorm != nil {
+        return fmt.Errorf("loudnorm measures a single audio track, select one")
+    }
+    // The joined mezzanine keeps only the first audio track of each source
+    if len(opts.Audio) > 0 && len(request.Concat) > 0 {
+        return fmt.Errorf("audio track selection is not supported with concat")
+    }
+    return nil
+}
+
+// selectAudioTracks resolves the job's audio selection against a file.
+// Without a selection the first track is kept, as ffmpeg would pick it.
+func selectAudioTracks(job *models.MediaJob, file *models.MediaFile) ([]audioTrack, error) {
+    var streams []models.ProbeStream
+    if file.Probe != nil {
+        streams = file.Probe.StreamsOfType("audio")
+    }
+
+    if job.Streams == nil || len(job.Streams.Audio) == 0 {
+        if file.Probe == nil {
+            return []audioTrack{{spec: "0:a:0?"}}, nil
+        }
+        if len(streams) == 0 {
+            return nil, nil
+        }
+        first := streams[0]
+        return []audioTrack{{spec: fmt.Sprintf("0:%d", first.Index), codec: first.Codec,
+            bitRate: first.BitRate, language: first.Language, title: first.Title}}, nil
+    }
+
+    var tracks []audioTrack
+    for i, selection := range job.Streams.Audio {
+        track := audioTrack{title: selection.Title, def: selection.Default, forced: selection.Forced}
+
+        var source *models.ProbeStream
+        switch {
+        case file.Probe == nil && selection.Language != "":
+            return nil, fmt.Errorf("selecting audio by language needs a probe of %s", file.Path)
+        case file.Probe == nil:
+            // Position alone still maps, the stream is taken on trust
+            track.spec = fmt.Sprintf("0:a:%d", *selection.Index)
+            if selection.Optional {
+                track.spec += "?"
+            }
+        case selection.Language != "":
+            for j := range streams {
+                if strings.EqualFold(streams[j].Language, selection.Language) {
+                    source = &streams[j]
+                    break
+                }
+            }
+        case *selection.Index < len(streams):
+            source = &streams[*selection.Index]
+        }
+
+        if source != nil {
+            track.spec = fmt.Sprintf("0:%d", source.Index)
+            track.codec = source.Codec
+            track.bitRate = source.BitRate
+            track.language = source.Language
+            if track.title == "" {
+                track.title = source.Title
+            }
+        } else if track.spec == "" {
+            if selection.Optional {
+                continue
+            }
+            return nil, fmt.Errorf("%s has no audio track matching selection %d", file.Path, i+1)
+        }
+        tracks = append(tracks, track)
+    }
+
+    // Without an explicit default the first kept track is the default
+    hasDefault := false
+    for _, track := range tracks {
+        hasDefault = hasDefault || track.def
+    }
+    if !hasDefault && len(tracks) > 0 {
+        tracks[0].def = true
+    }
+    return tracks, nil
+}
+
+// audioMapArgs maps the selected audio tracks into an output and labels
+// them. Dispositions are only set for an explicit selection, otherwise the
+// source's are kept.
+func audioMapArgs(job *models.MediaJob, tracks []audioTrack) []string {
+    explicit := job.Streams != nil && len(job.Streams.Audio) > 0
+
+    var args []string
+    for _, track := range tracks {
+        args = append(args, "-map", track.spec)
+    }
+    for i, track := range tracks {
+        if track.language != "" {
+            args = append(args, fmt.Sprintf("-metadata:s:a:%d", i), "language="+track.language)
+        }
+        if track.title != "" {
+            args = append(args, fmt.Sprintf("-metadata:s:a:%d", i), "title="+track.title)
+        }
+        if explicit {
+            args = append(args, fmt.Sprintf("-disposition:a:%d", i), trackDisposition(track))
+        }
+    }
+    return args
+}
+
+// trackDisposition is the -disposition value for a track
+func trackDisposition(track audioTrack) string {
+    switch {
+    case track.def && track.forced:
+        return "default+forced"
+    case track.def:
+        return "default"
+    case track.forced:
+        return "forced"
+    default:
+        return "0"
+    }
+}
+
+// copyMapArgs maps the streams of a stream copy, used for fast clips and
+// scene splits. Without a selection everything is copied.
+func copyMapArgs(job *models.MediaJob, file *models.MediaFile) ([]string, error) {
+    if job.Streams == nil || len(job.Streams.Audio) == 0 {
+        args := []string{"-map", "0"}
+        if job.Streams != nil && job.Streams.DropData {
+            args = append(args, "-dn")
+        }
+        return args, nil
+    }
+
+    tracks, err := selectAudioTracks(job, file)
+    if err != nil {
+        return nil, err
+    }
+    // Data streams are left out by not mapping them
+    args := []string{"-map", "0:v?"}
+    args = append(args, audioMapArgs(job, tracks)...)
+    return append(args, "-map", "0:s?", "-map", "0:t?"), nil
+}
+
+// hlsTrackName is an audio track's NAME in the master playlist, which the
+// variant stream map cannot quote
+func hlsTrackName(track audioTrack, i int) string {
+    name := track.title
+    if name == "" {
+        name = track.language
+    }
+    if name == "" {
+        name = fmt.Sprintf("audio_%d", i)
+    }
+    return trackNameChar.ReplaceAllString(name, "_")
+}
@@ -0,0 +1,379 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "task-automation-rig/models"
+)
+
+// textSubtitleCodecs are the subtitle codecs that can be converted between
+// each other and rendered by the subtitles filter. Everything else (PGS,
+// DVD and DVB subtitles) is a bitmap and can only be copied.
+var textSubtitleCodecs = map[string]bool{
+    "subrip":    true,
+    "srt":       true,
+    "ass":       true,
+    "ssa":       true,
+    "webvtt":    true,
+    "mov_text":  true,
+    "text":      true,
+    "microdvd":  true,
+    "subviewer": true,
+    "realtext":  true,
+    "sami":      true,
+}
+
+var subtitleFileExts = []string{".srt", ".ass", ".ssa", ".vtt"}
+
+var subtitleLanguage = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]+)*$`)
+
+// validateSubtitleOptions checks the subtitle block. The burn-in file has
+// already been confined to the source roots by the caller.
+func validateSubtitleOptions(request *models.MediaRequest) error {
+    opts := request.Subtitles
+    if opts == nil {
+        return nil
+    }
+
+    if opts.BurnStream != nil && opts.BurnFile != "" {
+        return fmt.Errorf("burn in either a subtitle stream or a subtitle file, not both")
+    }
+    if opts.BurnStream != nil && *opts.BurnStream < 0 {
+        return fmt.Errorf("burnStream must not be negative")
+    }
+    if opts.BurnFile != "" {
+        ext := strings.ToLower(filepath.Ext(opts.BurnFile))
+        supported := false
+        for _, subtitleExt := range subtitleFileExts {
+            if ext == subtitleExt {
+                supported = true
+            }
+        }
+        if !supported {
+            return fmt.Errorf("unsupported subtitle file: %s", filepath.Base(opts.BurnFile))
+        }
+    }
+
+    switch opts.ExtractFormat {
+    case "", "srt", "vtt", "ass":
+    default:
+        return fmt.Errorf("unsupported subtitle extract format: %s", opts.ExtractFormat)
+    }
+
+    if opts.Passthrough && request.OutputMode == models.OutputFiles && request.ContainerFormat == models.AVI {
+        return fmt.Errorf("avi cannot carry subtitles")
+    }
+
+    return nil
+}
+
+// subtitleBurnFilter is the filter rendering the selected subtitles into the
+// picture, empty when nothing is burned in. It runs before scaling so the
+// text is sized with the source frame.
+func subtitleBurnFilter(job *models.MediaJob, file *models.MediaFile) (string, error) {
+    opts := job.Subtitles
+    if opts == nil || (opts.BurnFile == "" && opts.BurnStream == nil) {
+        return "", nil
+    }
+
+    filter, err := subtitleRenderFilter(opts, file)
+    if err != nil {
+        return "", err
+    }
+
+    // Seeking into a clip restarts the frame timestamps at zero, move them
+    // back onto the source timeline while the subtitles are rendered
+    if offset := clipOffset(file); offset > 0 {
+        filter = fmt.Sprintf("setpts=PTS+%s/TB,%s,setpts=PTS-STARTPTS", formatSeconds(offset), filter)
+    }
+    return filter, nil
+}
+
+func subtitleRenderFilter(opts *models.SubtitleOptions, file *models.MediaFile) (string, error) {
+    if opts.BurnFile != "" {
+        return "subtitles=filename=" + filterEscape(opts.BurnFile), nil
+    }
+
+    index := *opts.BurnStream
+    if file.Probe != nil {
+        streams := file.Probe.StreamsOfType("subtitle")
+        if index >= len(streams) {
+            return "", fmt.Errorf("%s has %d subtitle streams, cannot burn in stream %d", file.Path, len(streams), index)
+        }
+        if !textSubtitleCodecs[streams[index].Codec] {
+            return "", fmt.Errorf("subtitle stream %d of %s is %s, only text subtitles can be burned in",
+                index, file.Path, streams[index].Codec)
+        }
+    }
+    return fmt.Sprintf("subtitles=filename=%s:si=%d", filterEscape(file.Path), index), nil
+}
+
+// subtitleArgs maps the subtitles of a standalone output file after its
+// video and audio. Without passthrough there are none.
+func subtitleArgs(job *models.MediaJob, file *models.MediaFile) []string {
+    if job.Subtitles == nil || !job.Subtitles.Passthrough {
+        return []string{"-sn"}
+    }
+    if file.Probe == nil {
+        log.Printf("Cannot pass subtitles of %s through without a probe\n", file.Path)
+        return []string{"-sn"}
+    }
+    streams := file.Probe.StreamsOfType("subtitle")
+    if len(streams) == 0 {
+        return []string{"-sn"}
+    }
+
+    var args []string
+    output := 0
+    for _, stream := range streams {
+        codec, ok := passthroughSubtitleCodec(job.ContainerFormat, stream.Codec)
+        if !ok {
+            log.Printf("Dropping %s subtitle stream %d of %s, %s cannot carry it\n",
+                stream.Codec, stream.Index, file.Path, job.ContainerFormat)
+            continue
+        }
+        args = append(args, "-map", fmt.Sprintf("0:%d", stream.Index), fmt.Sprintf("-c:s:%d", output), codec)
+        // Conversions can lose the labels, carry them over explicitly
+        if stream.Language != "" {
+            args = append(args, fmt.Sprintf("-metadata:s:s:%d", output), "language="+stream.Language)
+        }
+        if stream.Title != "" {
+            args = append(args, fmt.Sprintf("-metadata:s:s:%d", output), "title="+stream.Title)
+        }
+        output++
+    }
+    return args
+}
+
+// passthroughSubtitleCodec is the subtitle encoder a container needs.
+// Matroska keeps the source format except for MP4's own mov_text.
+func passthroughSubtitleCodec(format models.ContainerFormat, codec string) (string, bool) {
+    text := textSubtitleCodecs[codec]
+    switch format {
+    case models.MKV:
+        if codec == "mov_text" {
+            return "srt", true
+        }
+        return "copy", true
+    case models.WebM:
+        return "webvtt", text
+    default: // MP4
+        return "mov_text", text
+    }
+}
+
+// processSubtitles writes the subtitle sidecars of a source: every stream
+// when extracting, and WebVTT renditions of the text streams for adaptive
+// packages, which HLS then lists in the master playlist.
+func processSubtitles(job *models.MediaJob, file *models.MediaFile) error {
+    opts := job.Subtitles
+    if !opts.Extract && !(opts.Passthrough && job.OutputMode != models.OutputFiles) {
+        return nil
+    }
+    if file.Probe == nil {
+        log.Printf("Cannot find subtitles of %s without a probe\n", file.Path)
+        return nil
+    }
+    streams := file.Probe.StreamsOfType("subtitle")
+    if len(streams) == 0 {
+        return nil
+    }
+
+    fileName := file.Name
+    dir := job.DestinationPath
+    if job.OutputMode != models.OutputFiles {
+        dir = filepath.Dir(file.Manifest)
+    }
+
+    if opts.Extract {
+        var sidecars []models.SubtitleFile
+        for _, stream := range streams {
+            format := sidecarFormat(stream.Codec, opts.ExtractFormat)
+            name := fmt.Sprintf("%s_sub_%d", fileName, stream.Index)
+            if subtitleLanguage.MatchString(stream.Language) {
+                name += "." + stream.Language
+            }
+            path, err := safeJoin(dir, name+"."+format)
+            if err != nil {
+                return err
+            }
+            sidecars = append(sidecars, newSubtitleFile(stream, format, path))
+        }
+        if err := writeSubtitles(file, sidecars); err != nil {
+            return err
+        }
+        job.Lock()
+        file.SubtitleFiles = append(file.SubtitleFiles, sidecars...)
+        job.Unlock()
+    }
+
+    if opts.Passthrough && job.OutputMode != models.OutputFiles {
+        var tracks []models.SubtitleFile
+        for _, stream := range streams {
+            if !textSubtitleCodecs[stream.Codec] {
+                log.Printf("Skipping %s subtitle stream %d of %s, adaptive packages take text subtitles only\n",
+                    stream.Codec, stream.Index, file.Path)
+                continue
+            }
+            path, err := safeJoin(dir, fmt.Sprintf("subs_%d.vtt", len(tracks)))
+            if err != nil {
+                return err
+            }
+            tracks = append(tracks, newSubtitleFile(stream, "vtt", path))
+        }
+        if len(tracks) == 0 {
+            return nil
+        }
+        if err := writeSubtitles(file, tracks); err != nil {
+            return err
+        }
+
+        if job.OutputMode == models.OutputHLS {
+            if file.Duration <= 0 {
+                log.Printf("Not listing subtitles of %s in the playlist, its duration is unknown\n", file.Path)
+            } else {
+                for i := range tracks {
+                    playlist, err := writeSubtitlePlaylist(&tracks[i], file.Duration)
+                    if err != nil {
+                        return err
+                    }
+                    tracks[i].Playlist = playlist
+                }
+                if err := addSubtitlesToMaster(file.Manifest, tracks); err != nil {
+                    return err
+                }
+            }
+        }
+        job.Lock()
+        file.SubtitleFiles = append(file.SubtitleFiles, tracks...)
+        job.Unlock()
+    }
+
+    return nil
+}
+
+func newSubtitleFile(stream models.ProbeStream, format, path string) models.SubtitleFile {
+    return models.SubtitleFile{
+        Index:    stream.Index,
+        Language: stream.Language,
+        Title:    stream.Title,
+        Format:   format,
+        Path:     path,
+    }
+}
+
+// sidecarFormat picks the file format of an extracted stream. Text streams
+// convert to the requested format; bitmaps are copied as PGS .sup or, for
+// the other bitmap codecs, a subtitle-only Matroska file.
+func sidecarFormat(codec, requested string) string {
+    if !textSubtitleCodecs[codec] {
+        if codec == "hdmv_pgs_subtitle" {
+            return "sup"
+        }
+        return "mks"
+    }
+    if requested != "" {
+        return requested
+    }
+    switch codec {
+    case "ass", "ssa":
+        return "ass"
+    case "webvtt":
+        return "vtt"
+    default:
+        return "srt"
+    }
+}
+
+// writeSubtitles extracts the given streams of a file in one ffmpeg run
+func writeSubtitles(file *models.MediaFile, sidecars []models.SubtitleFile) error {
+    args := inputArgs(file)
+    for _, sidecar := range sidecars {
+        args = append(args, "-map", fmt.Sprintf("0:%d", sidecar.Index))
+        switch sidecar.Format {
+        case "srt":
+            args = append(args, "-c:s", "srt")
+        case "vtt":
+            args = append(args, "-c:s", "webvtt")
+        case "ass":
+            args = append(args, "-c:s", "ass")
+        case "mks":
+            args = append(args, "-c:s", "copy", "-f", "matroska")
+        default: // sup
+            args = append(args, "-c:s", "copy")
+        }
+        args = append(args, sidecar.Path)
+    }
+
+    if _, err := runFFmpegOutput(args...); err != nil {
+        return fmt.Errorf("failed to extract subtitles: %v", err)
+    }
+    return nil
+}
+
+// writeSubtitlePlaylist wraps a WebVTT file in a single-segment HLS media
+// playlist and returns the playlist path
+func writeSubtitlePlaylist(track *models.SubtitleFile, duration float64) (string, error) {
+    playlist := strings.TrimSuffix(track.Path, filepath.Ext(track.Path)) + ".m3u8"
+    content := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:%.3f,\n%s\n#EXT-X-ENDLIST\n",
+        int(math.Ceil(duration)), duration, filepath.Base(track.Path))
+    if err := os.WriteFile(playlist, []byte(content), 0644); err != nil {
+        return "", fmt.Errorf("failed to write subtitle playlist: %v", err)
+    }
+    return playlist, nil
+}
+
+// addSubtitlesToMaster lists the subtitle renditions in the master playlist
+// ffmpeg wrote and attaches the group to every variant
+func addSubtitlesToMaster(manifest string, tracks []models.SubtitleFile) error {
+    data, err := os.ReadFile(manifest)
+    if err != nil {
+        return fmt.Errorf("failed to read master playlist: %v", err)
+    }
+
+    // Quoted strings in playlists cannot hold quotes or line breaks
+    unquote := strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ")
+    var media []string
+    for i, track := range tracks {
+        name := track.Title
+        if name == "" {
+            name = track.Language
+        }
+        if name == "" {
+            name = fmt.Sprintf("Subtitles %d", i+1)
+        }
+        line := fmt.Sprintf(`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="%s",DEFAULT=NO,AUTOSELECT=YES`, unquote.Replace(name))
+        if subtitleLanguage.MatchString(track.Language) {
+            line += fmt.Sprintf(`,LANGUAGE="%s"`, track.Language)
+        }
+        media = append(media, line+fmt.Sprintf(`,URI="%s"`, filepath.Base(track.Playlist)))
+    }
+
+    var lines []string
+    for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+        if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+            // The renditions go ahead of the first variant
+            lines = append(lines, media...)
+            media = nil
+            line += `,SUBTITLES="subs"`
+        }
+        lines = append(lines, line)
+    }
+
+    if err := os.WriteFile(manifest, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+        return fmt.Errorf("failed to update master playlist: %v", err)
+    }
+    return nil
+}
+
+// filterEscape escapes a path for use as a filter option inside a filter
+// graph: once for the option parser and once more for the graph parser
+func filterEscape(value string) string {
+    value = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+    return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(value)
+}
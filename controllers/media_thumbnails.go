@@ -0,0 +1,191 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "os"
+    "path/filepath"
+    "strings"
+    "task-automation-rig/models"
+)
+
+// generatePreviews writes the poster, thumbnails and sprite sheet for a
+// source next to its transcodes
+func generatePreviews(job *models.MediaJob, file *models.MediaFile) error {
+    opts := job.Thumbnails
+    fileName := file.Name
+    log.Printf("Generating previews for: %s\n", file.Path)
+
+    posterOffset := opts.PosterOffset
+    if posterOffset == 0 {
+        posterOffset = file.Duration * 0.1
+    }
+    if file.Duration > 0 && posterOffset >= file.Duration {
+        posterOffset = file.Duration / 2
+    }
+
+    posterPath, err := safeJoin(job.DestinationPath, fileName+"_poster.jpg")
+    if err != nil {
+        return err
+    }
+    // Offsets are on the file's own timeline, clips seek into their source
+    if err := extractPoster(file.Path, posterPath, clipOffset(file)+posterOffset, opts); err != nil {
+        return err
+    }
+    addPreviews(job, file, models.PreviewImage{Type: "poster", Path: posterPath, Time: posterOffset})
+
+    if opts.Count > 0 {
+        if file.Duration <= 0 {
+            return fmt.Errorf("cannot space thumbnails without a known duration")
+        }
+        for i := 1; i <= opts.Count; i++ {
+            offset := file.Duration * float64(i) / float64(opts.Count+1)
+            thumbPath, err := safeJoin(job.DestinationPath, fmt.Sprintf("%s_thumb_%03d.jpg", fileName, i))
+            if err != nil {
+                return err
+            }
+            if _, err := runFFmpegOutput("-ss", formatSeconds(clipOffset(file)+offset), "-i", file.Path,
+                "-frames:v", "1", "-vf", fmt.Sprintf("scale=%d:-2", opts.Width), thumbPath); err != nil {
+                return err
+            }
+            addPreviews(job, file, models.PreviewImage{Type: "thumbnail", Path: thumbPath, Time: offset})
+        }
+    }
+
+    if opts.Sprite {
+        if err := generateSprite(job, file, fileName); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// extractPoster grabs a single frame at the offset, or in scene mode the
+// first frame after the offset that starts a new scene. A source without a
+// qualifying cut falls back to the offset frame.
+func extractPoster(source, posterPath string, offset float64, opts *models.ThumbnailOptions) error {
+    if opts.PosterMode == "scene" {
+        _, err := runFFmpegOutput("-ss", formatSeconds(offset), "-i", source,
+            "-vf", fmt.Sprintf("select='gt(scene,%.2f)'", opts.SceneThreshold),
+            "-frames:v", "1", posterPath)
+        if err == nil {
+            if info, statErr := os.Stat(posterPath); statErr == nil && info.Size() > 0 {
+                return nil
+            }
+        }
+        log.Printf("No scene cut found in %s, using the offset frame\n", source)
+    }
+
+    _, err := runFFmpegOutput("-ss", formatSeconds(offset), "-i", source, "-frames:v", "1", posterPath)
+    return err
+}
+
+// Sprite sheets index a file for scrubbing. Denser tiles would only build
+// a huge image from a high fps filter, so long files get wider spacing.
+// JPEG cannot encode a side longer than maxSpriteSide pixels.
+const (
+    minSpriteInterval = 0.5 // Seconds between tiles
+    maxSpriteTiles    = 1000
+    maxSpriteSide     = 65535
+    maxThumbnailWidth = 1920
+)
+
+// generateSprite tiles one frame every SpriteInterval seconds into a single
+// image and writes a WebVTT track pointing each cue at its tile
+func generateSprite(job *models.MediaJob, file *models.MediaFile, fileName string) error {
+    opts := job.Thumbnails
+    if file.Duration <= 0 || file.Probe == nil || file.Probe.VideoStream() == nil {
+        return fmt.Errorf("sprite sheets need a probed duration and video stream")
+    }
+
+    // Tile height follows the display aspect ratio, rounded to even
+    srcWidth, srcHeight := displaySize(file.Probe.VideoStream())
+    if srcWidth == 0 || srcHeight == 0 {
+        return fmt.Errorf("sprite sheets need the source dimensions")
+    }
+    tileWidth := opts.Width
+    tileHeight := int(math.Round(float64(tileWidth)*float64(srcHeight)/float64(srcWidth)/2)) * 2
+    if tileHeight < 2 || tileHeight > maxSpriteSide {
+        return fmt.Errorf("sprite tiles of %dx%d do not fit a sprite sheet", tileWidth, tileHeight)
+    }
+
+    // The sheet holds at most this many tiles within the JPEG size limit
+    columns := opts.SpriteColumns
+    if columns*tileWidth > maxSpriteSide {
+        columns = maxSpriteSide / tileWidth
+    }
+    maxTiles := columns * (maxSpriteSide / tileHeight)
+    if maxTiles > maxSpriteTiles {
+        maxTiles = maxSpriteTiles
+    }
+
+    interval := opts.SpriteInterval
+    if file.Duration/interval > float64(maxTiles) {
+        interval = file.Duration / float64(maxTiles)
+        log.Printf("Spacing sprite tiles of %s %.2fs apart to stay within %d tiles\n", file.Path, interval, maxTiles)
+    }
+    tiles := int(math.Ceil(file.Duration / interval))
+    if tiles > maxTiles {
+        // Rounding in a stretched interval can count one tile too many
+        tiles = maxTiles
+    }
+    if tiles < columns {
+        columns = tiles
+    }
+    rows := (tiles + columns - 1) / columns
+
+    spritePath, err := safeJoin(job.DestinationPath, fileName+"_sprite.jpg")
+    if err != nil {
+        return err
+    }
+    vttPath, err := safeJoin(job.DestinationPath, fileName+"_sprite.vtt")
+    if err != nil {
+        return err
+    }
+
+    filter := fmt.Sprintf("fps=1/%g,scale=%d:%d,tile=%dx%d", interval, tileWidth, tileHeight, columns, rows)
+    args := append(inputArgs(file), "-vf", filter, "-frames:v", "1", spritePath)
+    if _, err := runFFmpegOutput(args...); err != nil {
+        return err
+    }
+
+    var vtt strings.Builder
+    vtt.WriteString("WEBVTT\n")
+    spriteName := filepath.Base(spritePath)
+    for i := 0; i < tiles; i++ {
+        start := float64(i) * interval
+        end := math.Min(start+interval, file.Duration)
+        x := (i % columns) * tileWidth
+        y := (i / columns) * tileHeight
+        vtt.WriteString(fmt.Sprintf("\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+            vttTimestamp(start), vttTimestamp(end), spriteName, x, y, tileWidth, tileHeight))
+    }
+    if err := os.WriteFile(vttPath, []byte(vtt.String()), 0644); err != nil {
+        return err
+    }
+
+    addPreviews(job, file,
+        models.PreviewImage{Type: "sprite", Path: spritePath},
+        models.PreviewImage{Type: "vtt", Path: vttPath})
+    return nil
+}
+
+// addPreviews records finished previews on a file under the job lock
+func addPreviews(job *models.MediaJob, file *models.MediaFile, previews ...models.PreviewImage) {
+    job.Lock()
+    defer job.Unlock()
+    file.Previews = append(file.Previews, previews...)
+}
+
+// formatSeconds renders an ffmpeg time argument
+func formatSeconds(seconds float64) string {
+    return fmt.Sprintf("%.3f", seconds)
+}
+
+// vttTimestamp renders seconds as HH:MM:SS.mmm
+func vttTimestamp(seconds float64) string {
+    ms := int64(math.Round(seconds * 1000))
+    return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
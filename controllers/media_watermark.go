@@ -0,0 +1,155 @@
+package controllers
+
+import (
+    "fmt"
+    "regexp"
+    "task-automation-rig/models"
+)
+
+var watermarkColor = regexp.MustCompile(`^([A-Za-z]+|#[0-9A-Fa-f]{6}([0-9A-Fa-f]{2})?)$`)
+
+// validateWatermarks checks the overlays and fills in their defaults. Image
+// and font files have already been confined to the source roots.
+func validateWatermarks(filters *models.VideoFilter) error {
+    if filters == nil {
+        return nil
+    }
+    if len(filters.Watermarks) > 8 {
+        return fmt.Errorf("at most 8 watermarks per job")
+    }
+
+    for i := range filters.Watermarks {
+        wm := &filters.Watermarks[i]
+        if (wm.Image == "") == (wm.Text == "") {
+            return fmt.Errorf("watermark %d needs either an image or a text", i+1)
+        }
+
+        switch wm.Position {
+        case "":
+            wm.Position = "bottom-right"
+        case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+        default:
+            return fmt.Errorf("watermark %d: unsupported position %s", i+1, wm.Position)
+        }
+        if wm.FontColor == "" {
+            wm.FontColor = "white"
+        }
+        if !watermarkColor.MatchString(wm.FontColor) {
+            return fmt.Errorf("watermark %d: invalid font color %s", i+1, wm.FontColor)
+        }
+        if wm.Margin == 0 {
+            wm.Margin = 20
+        }
+        if wm.Opacity == 0 {
+            wm.Opacity = 1
+        }
+        if wm.Scale == 0 {
+            wm.Scale = 0.15
+            if wm.Text != "" {
+                wm.Scale = 0.03
+            }
+        }
+
+        if wm.Margin < 0 || wm.Opacity < 0 || wm.Opacity > 1 || wm.Scale < 0 || wm.Scale > 1 {
+            return fmt.Errorf("watermark %d: margin must be positive, opacity and scale between 0 and 1", i+1)
+        }
+        if wm.Start < 0 || (wm.End != 0 && wm.End <= wm.Start) {
+            return fmt.Errorf("watermark %d: end must come after start", i+1)
+        }
+    }
+    return nil
+}
+
+// watermarkInputs opens the watermark images as extra ffmpeg inputs. They
+// follow the source, so the first image is input 1.
+func watermarkInputs(filters *models.VideoFilter) []string {
+    var args []string
+    if filters == nil {
+        return args
+    }
+    for _, wm := range filters.Watermarks {
+        if wm.Image != "" {
+            args = append(args, "-i", wm.Image)
+        }
+    }
+    return args
+}
+
+// watermarkGraph draws every watermark over the pad in and leaves the result
+// on the pad out. Intermediate pads are named after out so several
+// renditions can share one graph.
+func watermarkGraph(watermarks []models.Watermark, in, out string) []string {
+    var graph []string
+    image := 1
+    current := in
+    for i, wm := range watermarks {
+        next := fmt.Sprintf("%s_wm%d", out, i)
+        if i == len(watermarks)-1 {
+            next = out
+        }
+
+        enable := ""
+        if wm.Start > 0 || wm.End > 0 {
+            if wm.End > 0 {
+                enable = fmt.Sprintf(":enable='between(t,%g,%g)'", wm.Start, wm.End)
+            } else {
+                enable = fmt.Sprintf(":enable='gte(t,%g)'", wm.Start)
+            }
+        }
+
+        if wm.Image != "" {
+            logo := fmt.Sprintf("%s_logo%d", out, i)
+            ref := fmt.Sprintf("%s_ref%d", out, i)
+            x, y := watermarkPosition(wm.Position, wm.Margin, "W", "H", "w", "h")
+            graph = append(graph,
+                fmt.Sprintf("[%d:v]format=rgba,colorchannelmixer=aa=%g[%s]", image, wm.Opacity, logo),
+                // scale2ref sizes the image against the frame it is drawn on
+                fmt.Sprintf("[%s][%s]scale2ref=w=main_w*%g:h=ow/a[%s][%s]", logo, current, wm.Scale, logo+"s", ref),
+                fmt.Sprintf("[%s][%s]overlay=x=%s:y=%s%s[%s]", ref, logo+"s", x, y, enable, next))
+            image++
+        } else {
+            x, y := watermarkPosition(wm.Position, wm.Margin, "w", "h", "tw", "th")
+            text := fmt.Sprintf("drawtext=text=%s:expansion=none:fontsize=w*%g:fontcolor=%s:alpha=%g:x=%s:y=%s%s",
+                filterEscape(wm.Text), wm.Scale, filterColor(wm.FontColor), wm.Opacity, x, y, enable)
+            if wm.FontFile != "" {
+                text += ":fontfile=" + filterEscape(wm.FontFile)
+            }
+            graph = append(graph, fmt.Sprintf("[%s]%s[%s]", current, text, next))
+        }
+        current = next
+    }
+    return graph
+}
+
+// watermarkPosition is the x and y expressions placing an overlay of size
+// w x h on a frame of size W x H
+func watermarkPosition(position string, margin int, frameW, frameH, w, h string) (string, string) {
+    left := fmt.Sprint(margin)
+    top := fmt.Sprint(margin)
+    right := fmt.Sprintf("%s-%s-%d", frameW, w, margin)
+    bottom := fmt.Sprintf("%s-%s-%d", frameH, h, margin)
+
+    switch position {
+    case "top-left":
+        return left, top
+    case "top-right":
+        return right, top
+    case "bottom-left":
+        return left, bottom
+    case "center":
+        return fmt.Sprintf("(%s-%s)/2", frameW, w), fmt.Sprintf("(%s-%s)/2", frameH, h)
+    default: // bottom-right
+        return right, bottom
+    }
+}
+
+// videoInputPad is the source video stream as a filter graph input. The
+// probed index avoids picking up cover art stored as a video stream.
+func videoInputPad(file *models.MediaFile) string {
+    if file.Probe != nil {
+        if stream := file.Probe.VideoStream(); stream != nil {
+            return fmt.Sprintf("0:%d", stream.Index)
+        }
+    }
+    return "0:v:0"
+}
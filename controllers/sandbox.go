@@ -0,0 +1,126 @@
+package controllers
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// pathSandbox confines job inputs and outputs to the configured roots
+type pathSandbox struct {
+    sourceRoots      []string
+    destinationRoots []string
+}
+
+func newPathSandbox(sourceRoots, destinationRoots []string) *pathSandbox {
+    return &pathSandbox{
+        sourceRoots:      resolveRoots(sourceRoots),
+        destinationRoots: resolveRoots(destinationRoots),
+    }
+}
+
+// checkSource resolves a path that a job will read and verifies it lies
+// inside an allowed source root. The resolved path is returned so callers
+// hand the tools exactly what was checked.
+func (s *pathSandbox) checkSource(path string) (string, error) {
+    return checkWithin(path, s.sourceRoots, "source")
+}
+
+// checkDestination resolves a path that a job will write and verifies it
+// lies inside an allowed destination root.
+func (s *pathSandbox) checkDestination(path string) (string, error) {
+    return checkWithin(path, s.destinationRoots, "destination")
+}
+
+func checkWithin(path string, roots []string, kind string) (string, error) {
+    resolved, err := resolvePath(path)
+    if err != nil {
+        return "", fmt.Errorf("cannot resolve %s path %s: %v", kind, path, err)
+    }
+    // Without roots nothing is allowed, never everything
+    if len(roots) == 0 {
+        return "", fmt.Errorf("no allowed %s roots are configured", kind)
+    }
+    for _, root := range roots {
+        if isWithin(root, resolved) {
+            return resolved, nil
+        }
+    }
+    return "", fmt.Errorf("%s path %s is outside the allowed %s roots", kind, path, kind)
+}
+
+// resolvePath returns the absolute path with every symlink and ".." resolved.
+// Trailing components that do not exist yet, such as a destination about to
+// be created, are appended to their deepest existing ancestor and may not
+// contain "..".
+func resolvePath(path string) (string, error) {
+    if !filepath.IsAbs(path) {
+        wd, err := os.Getwd()
+        if err != nil {
+            return "", err
+        }
+        // Plain concatenation so ".." is resolved against real directories,
+        // not lexically, by EvalSymlinks below
+        path = wd + string(filepath.Separator) + path
+    }
+
+    parts := strings.Split(path, string(filepath.Separator))
+    for i := len(parts); i > 0; i-- {
+        prefix := strings.Join(parts[:i], string(filepath.Separator))
+        if prefix == "" {
+            prefix = string(filepath.Separator)
+        }
+        resolved, err := filepath.EvalSymlinks(prefix)
+        if err == nil {
+            // A ".." below a missing directory would only be cleaned away
+            // lexically, after which the OS may follow a symlink out of
+            // the root the check approved
+            for _, part := range parts[i:] {
+                if part == ".." {
+                    return "", fmt.Errorf("%s steps back out of a directory that does not exist", path)
+                }
+            }
+            return filepath.Join(append([]string{resolved}, parts[i:]...)...), nil
+        }
+        if !os.IsNotExist(err) {
+            return "", err
+        }
+    }
+    return filepath.Clean(path), nil
+}
+
+func resolveRoots(roots []string) []string {
+    resolved := make([]string, 0, len(roots))
+    for _, root := range roots {
+        path, err := resolvePath(root)
+        if err != nil {
+            // Keep the root as written rather than dropping it, which would
+            // silently lift the restriction
+            log.Printf("Cannot resolve allowed root %s: %v\n", root, err)
+            path = filepath.Clean(root)
+        }
+        resolved = append(resolved, path)
+    }
+    return resolved
+}
+
+// isWithin reports whether path is root itself or lies below it
+func isWithin(root, path string) bool {
+    rel, err := filepath.Rel(root, path)
+    if err != nil {
+        return false
+    }
+    return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// safeJoin joins elements onto root and refuses results that escape it, so
+// names taken from sources or archives can never place output elsewhere.
+func safeJoin(root string, elem ...string) (string, error) {
+    path := filepath.Join(append([]string{root}, elem...)...)
+    if !isWithin(filepath.Clean(root), path) {
+        return "", fmt.Errorf("output path %s escapes %s", path, root)
+    }
+    return path, nil
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+    "log"
+    "runtime"
+    "sync"
+    "task-automation-rig/config"
+)
+
+// Job kinds, each runs on its own worker pool
+const (
+    backupJobs = "backup"
+    mediaJobs  = "media"
+)
+
+// Scheduler queues jobs and runs them on bounded worker pools, one pool per
+// job kind, so a burst of requests waits its turn instead of starting every
+// tar and ffmpeg process at once
+type Scheduler struct {
+    pools map[string]*workerPool
+}
+
+// ffmpegSlots bounds the ffmpeg processes running at once. Worker pools
+// count jobs, but one media job fans out over files and chunks; every
+// ffmpeg run takes a slot so that fan-out cannot outgrow the machine.
+var ffmpegSlots = make(chan struct{}, runtime.NumCPU())
+
+// workerPool runs at most workers jobs at a time and queues the rest in
+// submission order
+type workerPool struct {
+    kind    string
+    mu      sync.Mutex
+    workers int
+    running int
+    queue   []queuedJob
+}
+
+type queuedJob struct {
+    id  string
+    run func()
+}
+
+func NewScheduler(cfg *config.Config) *Scheduler {
+    if cfg.FFmpegProcesses > 0 {
+        ffmpegSlots = make(chan struct{}, cfg.FFmpegProcesses)
+    }
+    return &Scheduler{
+        pools: map[string]*workerPool{
+            backupJobs: newWorkerPool(backupJobs, cfg.BackupWorkers),
+            mediaJobs:  newWorkerPool(mediaJobs, cfg.MediaWorkers),
+        },
+    }
+}
+
+func newWorkerPool(kind string, workers int) *workerPool {
+    if workers < 1 {
+        workers = 1
+    }
+    return &workerPool{kind: kind, workers: workers}
+}
+
+// submit queues run under id and starts it as soon as a worker is free
+func (s *Scheduler) submit(kind, id string, run func()) {
+    pool := s.pools[kind]
+    pool.mu.Lock()
+    pool.queue = append(pool.queue, queuedJob{id, run})
+    log.Printf("Queued %s job %s (%d waiting, %d running)\n", kind, id, len(pool.queue), pool.running)
+    pool.dispatch()
+    pool.mu.Unlock()
+}
+
+// position is the 1-based place of a job in its queue, 0 once it has started
+func (s *Scheduler) position(kind, id string) int {
+    pool := s.pools[kind]
+    pool.mu.Lock()
+    defer pool.mu.Unlock()
+
+    for i, job := range pool.queue {
+        if job.id == id {
+            return i + 1
+        }
+    }
+    return 0
+}
+
+// dispatch starts queued jobs while workers are free. Callers hold mu.
+func (p *workerPool) dispatch() {
+    for p.running < p.workers && len(p.queue) > 0 {
+        job := p.queue[0]
+        p.queue = p.queue[1:]
+        p.running++
+
+        go func() {
+            defer func() {
+                p.mu.Lock()
+                p.running--
+                p.dispatch()
+                p.mu.Unlock()
+            }()
+            job.run()
+        }()
+    }
+}
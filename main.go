@@ -5,10 +5,16 @@ import (
 
     "github.com/gofiber/fiber/v2"
     "github.com/gofiber/fiber/v2/middleware/logger"
+    "task-automation-rig/config"
     "task-automation-rig/routes"
 )
 
 func main() {
+    cfg := config.Load()
+    if len(cfg.AllowedSourceRoots) == 0 || len(cfg.AllowedDestinationRoots) == 0 {
+        log.Fatal("ALLOWED_SOURCE_ROOTS and ALLOWED_DESTINATION_ROOTS must be set, jobs are confined to them")
+    }
+
     app := fiber.New(fiber.Config{
         ErrorHandler: func(c *fiber.Ctx, err error) error {
             return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -21,7 +27,7 @@ func main() {
     app.Use(logger.New())
 
     // Setup routes
-    routes.SetupRoutes(app)
+    routes.SetupRoutes(app, cfg)
 
     // Start server
     log.Fatal(app.Listen(":3000"))
@@ -12,12 +12,15 @@ const (
     Zip    CompressionType = "zip"     // ZIP archive
     SevenZ CompressionType = "7z"      // 7-Zip archive
     Rar    CompressionType = "rar"     // RAR archive
+    Snapshot CompressionType = "snapshot" // Plain directory tree, unchanged files hard-linked to the previous snapshot
 )
 
 type BackupRequest struct {
     Paths           []string        `json:"paths"`           // List of source paths to backup
     DestinationPath string         `json:"destinationPath"` // Destination path for the backup
     CompressionType CompressionType `json:"compressionType"` // Type of compression to use
+    Reproducible    bool            `json:"reproducible,omitempty"` // Produce byte-identical archives for identical inputs
+    ParityPercent   int             `json:"parityPercent,omitempty"` // Reed-Solomon redundancy to store next to the archive, 0 disables
 }
 
 type Backup struct {
@@ -25,8 +28,36 @@ type Backup struct {
     Paths           []string       `json:"paths"`
     DestinationPath string         `json:"destinationPath"`
     CompressionType CompressionType `json:"compressionType"`
+    Reproducible    bool           `json:"reproducible,omitempty"`
     Status          string         `json:"status"`
+    Checksum        string         `json:"checksum,omitempty"` // SHA-256 of the finished archive
+    LinkedFrom      string         `json:"linkedFrom,omitempty"` // Previous snapshot unchanged files were hard-linked from
+    ParityPercent   int            `json:"parityPercent,omitempty"`
+    ParityPath      string         `json:"parityPath,omitempty"` // par2 index next to the archive
     StartTime       time.Time      `json:"startTime"`
     EndTime         time.Time      `json:"endTime,omitempty"`
     Error           string         `json:"error,omitempty"`
-}
\ No newline at end of file
+    LastScrubTime   time.Time      `json:"lastScrubTime,omitempty"`
+    ScrubOutcome    string         `json:"scrubOutcome,omitempty"` // ok, corrupted or skipped
+    ScrubError      string         `json:"scrubError,omitempty"`
+}
+
+// ScrubReport is the latest integrity check result for one backup
+type ScrubReport struct {
+    BackupID        string    `json:"backupId"`
+    DestinationPath string    `json:"destinationPath"`
+    Status          string    `json:"status"`
+    LastScrubTime   time.Time `json:"lastScrubTime,omitempty"`
+    Outcome         string    `json:"outcome,omitempty"`
+    Error           string    `json:"error,omitempty"`
+}
+
+// IsTar reports whether archives of this type are produced by tar
+func (t CompressionType) IsTar() bool {
+    switch t {
+    case Tar, TarGz, TarBz2, TarXz:
+        return true
+    default:
+        return false
+    }
+}
@@ -1,10 +1,20 @@
 package models
 
-import "time"
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+    "sync"
+    "time"
+)
 
 type CodecType string
+type AudioCodec string
 type Resolution string
 type ContainerFormat string
+type OutputMode string
+type RateControlMode string
+type ScaleMode string
 
 const (
     // Video Codecs
@@ -14,6 +24,15 @@ const (
     AV1  CodecType = "av1"
 )
 
+const (
+    // Audio Codecs
+    AudioAAC  AudioCodec = "aac"
+    AudioOpus AudioCodec = "opus"
+    AudioMP3  AudioCodec = "mp3"
+    AudioFLAC AudioCodec = "flac"
+    AudioCopy AudioCodec = "copy" // Pass the source audio through untouched
+)
+
 const (
     // Containers
     MP4  ContainerFormat = "mp4"
@@ -22,6 +41,20 @@ const (
     AVI  ContainerFormat = "avi"
 )
 
+const (
+    // Output modes
+    OutputFiles OutputMode = "files" // One standalone file per resolution
+    OutputHLS   OutputMode = "hls"   // HLS ladder with a master playlist
+    OutputDASH  OutputMode = "dash"  // MPEG-DASH ladder with an MPD
+)
+
+const (
+    // Rate control modes
+    RateCRF        RateControlMode = "crf"        // Constant quality
+    RateBitrate    RateControlMode = "bitrate"    // Average bitrate with an optional VBV cap
+    RateTargetSize RateControlMode = "targetSize" // Two-pass encode sized to fit a file size limit
+)
+
 const (
     // Standard Resolutions
     Res360p  Resolution = "360p"   // 640x360
@@ -29,6 +62,15 @@ const (
     Res540p  Resolution = "540p"   // 960x540
     Res720p  Resolution = "720p"   // 1280x720
     Res1080p Resolution = "1080p"  // 1920x1080
+    Res1440p Resolution = "1440p"  // 2560x1440
+    Res2160p Resolution = "2160p"  // 3840x2160
+)
+
+const (
+    // Scale modes, all of them keep the source aspect ratio
+    ScaleFit  ScaleMode = "fit"  // Fit inside the box, output may be smaller on one side
+    ScaleFill ScaleMode = "fill" // Cover the box and crop the overflow
+    ScalePad  ScaleMode = "pad"  // Fit inside the box and letterbox to its exact size
 )
 
 // VideoFilter represents different FFmpeg filter options
@@ -42,46 +84,454 @@ type VideoFilter struct {
     Speed          float64 `json:"speed,omitempty"`
     Rotate         int     `json:"rotate,omitempty"`
     Grayscale      bool    `json:"grayscale,omitempty"`
+    Watermarks     []Watermark `json:"watermarks,omitempty"`
+    Steps          []FilterStep `json:"steps,omitempty"` // Applied in order to the source, ahead of scaling and the flags above
+}
+
+// FilterStep is one stage of the video filter chain. Type selects the
+// filter and which of the other fields apply to it.
+type FilterStep struct {
+    Type      string  `json:"type"`                // crop, pad, fps, transpose, denoise, sharpen, curves, lut, fade or blur
+    Width     int     `json:"width,omitempty"`     // crop, pad: frame size in pixels
+    Height    int     `json:"height,omitempty"`
+    X         *int    `json:"x,omitempty"`         // crop, pad: top-left corner, centred when unset
+    Y         *int    `json:"y,omitempty"`
+    Color     string  `json:"color,omitempty"`     // pad, fade: color name or #RRGGBB, defaults to black
+    FPS       float64 `json:"fps,omitempty"`       // fps: output frame rate
+    Direction string  `json:"direction,omitempty"` // transpose: clockwise, counterclockwise, 180, hflip or vflip; fade: in or out
+    Strength  float64 `json:"strength,omitempty"`  // denoise 0 to 20 (default 4), sharpen -2 to 5 (default 1), blur sigma 0 to 50 (default 2)
+    Preset    string  `json:"preset,omitempty"`    // curves: one of ffmpeg's curve presets
+    File      string  `json:"file,omitempty"`      // lut: .cube or .3dl file
+    Start     float64 `json:"start,omitempty"`     // fade: seconds into the file; a fade out defaults to ending with the file
+    Duration  float64 `json:"duration,omitempty"`  // fade: seconds, defaults to 1
+}
+
+// AudioFilterStep is one stage of the audio filter chain, applied ahead of
+// loudness normalisation
+type AudioFilterStep struct {
+    Type      string  `json:"type"`                // volume, highpass, lowpass, fade, compressor or denoise
+    Gain      float64 `json:"gain,omitempty"`      // volume: dB
+    Frequency float64 `json:"frequency,omitempty"` // highpass, lowpass: cutoff in Hz
+    Direction string  `json:"direction,omitempty"` // fade: in or out
+    Start     float64 `json:"start,omitempty"`     // fade: seconds into the file; a fade out defaults to ending with the file
+    Duration  float64 `json:"duration,omitempty"`  // fade: seconds, defaults to 1
+    Threshold float64 `json:"threshold,omitempty"` // compressor: dB, defaults to -18
+    Ratio     float64 `json:"ratio,omitempty"`     // compressor: 1 to 20, defaults to 4
+    Strength  float64 `json:"strength,omitempty"`  // denoise: dB of noise reduction, defaults to 12
+}
+
+// Watermark is an image or text overlay drawn on every rendition, sized
+// relative to the rendition's width
+type Watermark struct {
+    Image     string  `json:"image,omitempty"`     // Image file to overlay, PNG keeps its transparency
+    Text      string  `json:"text,omitempty"`      // Text to draw when no image is given
+    FontFile  string  `json:"fontFile,omitempty"`  // Font for text, defaults to fontconfig's choice
+    FontColor string  `json:"fontColor,omitempty"` // Color name or #RRGGBB, defaults to white
+    Position  string  `json:"position,omitempty"`  // top-left, top-right, bottom-left, bottom-right (default) or center
+    Margin    int     `json:"margin,omitempty"`    // Pixels from the edges, defaults to 20
+    Opacity   float64 `json:"opacity,omitempty"`   // 0 to 1, defaults to 1
+    Scale     float64 `json:"scale,omitempty"`     // Image width, or text height, as a fraction of the output width; defaults to 0.15 and 0.03
+    Start     float64 `json:"start,omitempty"`     // Seconds into the output the watermark appears
+    End       float64 `json:"end,omitempty"`       // Seconds into the output it disappears, 0 for the end
+}
+
+// PackagingOptions controls segmenting for the hls and dash output modes
+type PackagingOptions struct {
+    SegmentDuration int  `json:"segmentDuration,omitempty"` // Seconds per segment, defaults to 6
+    FMP4            bool `json:"fmp4,omitempty"`            // fMP4/CMAF segments for HLS instead of MPEG-TS; DASH always uses fMP4
+}
+
+// ThumbnailOptions controls the preview images generated for every source.
+// A poster is always produced; thumbnails and the sprite sheet are optional.
+type ThumbnailOptions struct {
+    PosterMode     string  `json:"posterMode,omitempty"`     // "offset" (default) or "scene"
+    PosterOffset   float64 `json:"posterOffset,omitempty"`   // Seconds, defaults to 10% of the duration; scene mode searches from here
+    SceneThreshold float64 `json:"sceneThreshold,omitempty"` // Scene score a poster frame must exceed, defaults to 0.4
+    Count          int     `json:"count,omitempty"`          // Evenly spaced thumbnails
+    Width          int     `json:"width,omitempty"`          // Thumbnail and sprite tile width, defaults to 320
+    Sprite         bool    `json:"sprite,omitempty"`         // Sprite sheet with a WebVTT index for scrubbing
+    SpriteInterval float64 `json:"spriteInterval,omitempty"` // Seconds between sprite tiles, defaults to 10 and at least 0.5; stretched to keep a sheet within 1000 tiles
+    SpriteColumns  int     `json:"spriteColumns,omitempty"`  // Tiles per sprite row, defaults to 10
+}
+
+// PreviewImage is a generated preview of a source file
+type PreviewImage struct {
+    Type string  `json:"type"`           // poster, thumbnail, sprite or vtt
+    Path string  `json:"path"`
+    Time float64 `json:"time,omitempty"` // Seconds into the source the frame was taken from
+}
+
+// LoudnormOptions are EBU R128 targets for two-pass loudnorm
+type LoudnormOptions struct {
+    Integrated float64 `json:"integrated,omitempty"` // Integrated loudness in LUFS, defaults to -23
+    TruePeak   float64 `json:"truePeak,omitempty"`   // Maximum true peak in dBTP, defaults to -1
+    LRA        float64 `json:"lra,omitempty"`        // Loudness range in LU, defaults to 7
+}
+
+// AudioOptions controls how audio is encoded. Without them the source audio
+// is copied when the container accepts it and re-encoded otherwise.
+type AudioOptions struct {
+    Codec      AudioCodec       `json:"codec,omitempty"`
+    Bitrate    string           `json:"bitrate,omitempty"`    // e.g. "128k"
+    Channels   int              `json:"channels,omitempty"`
+    SampleRate int              `json:"sampleRate,omitempty"` // Hz
+    Loudnorm   *LoudnormOptions `json:"loudnorm,omitempty"`
+    Filters    []AudioFilterStep `json:"filters,omitempty"`
+}
+
+// LoudnessMeasurement is the first loudnorm pass over a source
+type LoudnessMeasurement struct {
+    Integrated   float64 `json:"integrated"`   // LUFS
+    TruePeak     float64 `json:"truePeak"`     // dBTP
+    LRA          float64 `json:"lra"`          // LU
+    Threshold    float64 `json:"threshold"`    // LUFS
+    TargetOffset float64 `json:"targetOffset"` // LU
+}
+
+// RateControl selects how the video bitrate is decided
+type RateControl struct {
+    Mode         RateControlMode `json:"mode"`
+    CRF          *int            `json:"crf,omitempty"`          // crf mode, defaults per codec; 0 is lossless on most codecs
+    BitrateKbps  int             `json:"bitrateKbps,omitempty"`  // bitrate mode
+    MaxRateKbps  int             `json:"maxRateKbps,omitempty"`  // bitrate mode VBV ceiling
+    BufSizeKbps  int             `json:"bufSizeKbps,omitempty"`  // bitrate mode VBV buffer, defaults to twice the max rate
+    TargetSizeMB float64         `json:"targetSizeMB,omitempty"` // targetSize mode, megabytes (10^6 bytes) per output file
+}
+
+// SubtitleOptions controls what happens to subtitles. Without them subtitle
+// streams are dropped from the outputs.
+type SubtitleOptions struct {
+    BurnStream    *int   `json:"burnStream,omitempty"`    // Source subtitle stream to render into the picture, counted among subtitle streams
+    BurnFile      string `json:"burnFile,omitempty"`      // External .srt, .ass, .ssa or .vtt file to render into the picture
+    Passthrough   bool   `json:"passthrough,omitempty"`   // Carry text subtitles into the outputs, converted to the container's format
+    Extract       bool   `json:"extract,omitempty"`       // Write every subtitle stream to a sidecar file
+    ExtractFormat string `json:"extractFormat,omitempty"` // srt, vtt or ass for text streams, defaults to the source format
+}
+
+// StreamOptions picks the source streams that go into the outputs
+type StreamOptions struct {
+    Audio    []AudioTrack `json:"audio,omitempty"`    // Audio tracks in output order, defaults to the first source track
+    DropData bool         `json:"dropData,omitempty"` // Leave data streams such as timecode tracks out of copied clips and scenes
+}
+
+// AudioTrack selects one source audio track by language or by position
+type AudioTrack struct {
+    Language string `json:"language,omitempty"` // First source track tagged with this ISO 639 code, e.g. "eng"
+    Index    *int   `json:"index,omitempty"`    // Position among the source's audio tracks, from 0
+    Title    string `json:"title,omitempty"`    // Replaces the source track's title
+    Default  bool   `json:"default,omitempty"`  // Players pick this track first; without one the first track is the default
+    Forced   bool   `json:"forced,omitempty"`
+    Optional bool   `json:"optional,omitempty"` // Leave the track out when the source has no match instead of failing
+}
+
+// SubtitleFile is a subtitle sidecar written for a source file
+type SubtitleFile struct {
+    Index    int    `json:"index"`              // Source stream index
+    Language string `json:"language,omitempty"`
+    Title    string `json:"title,omitempty"`
+    Format   string `json:"format"`             // srt, vtt, ass, sup or mks
+    Path     string `json:"path"`
+    Playlist string `json:"playlist,omitempty"` // Subtitle media playlist referenced from the HLS master playlist
+}
+
+// Clip is a span of a source to keep. Timestamps are seconds or
+// [HH:]MM:SS[.mmm].
+type Clip struct {
+    Start    string `json:"start"`
+    End      string `json:"end"`
+    Accurate bool   `json:"accurate,omitempty"` // Frame-accurate cut through the encoder; otherwise a stream copy cut at keyframes
+}
+
+// ClipRange is the part of a source a media file covers
+type ClipRange struct {
+    Index    int     `json:"index"` // 1-based position in the job's clips
+    Start    float64 `json:"start"` // Seconds into the source
+    End      float64 `json:"end"`
+    Accurate bool    `json:"accurate"`
+}
+
+// SceneOptions turns on scene detection. Scenes become chapters in mp4 and
+// mkv outputs and can also be split into files of their own.
+type SceneOptions struct {
+    Threshold   float64 `json:"threshold,omitempty"`   // Scene score a cut must exceed, defaults to 0.4
+    MinDuration float64 `json:"minDuration,omitempty"` // Seconds; shorter scenes merge into the one before, defaults to 10
+    Split       bool    `json:"split,omitempty"`       // Also cut the source into one file per scene
+}
+
+// Scene is a detected scene of a media file
+type Scene struct {
+    Index int     `json:"index"`          // 1-based
+    Start float64 `json:"start"`          // Seconds into the file
+    End   float64 `json:"end"`
+    Path  string  `json:"path,omitempty"` // Split file, when splitting
+}
+
+// QualityOptions measures every rendition against its source once encoded.
+// A rendition scoring below a minimum fails the job.
+type QualityOptions struct {
+    VMAF    bool    `json:"vmaf,omitempty"`    // Also compute VMAF, when the ffmpeg build has libvmaf
+    MinSSIM float64 `json:"minSsim,omitempty"` // 0 to 1
+    MinPSNR float64 `json:"minPsnr,omitempty"` // dB
+    MinVMAF float64 `json:"minVmaf,omitempty"` // 0 to 100, implies vmaf
+}
+
+// QualityScores are the objective metrics of one rendition
+type QualityScores struct {
+    SSIM float64  `json:"ssim"`
+    PSNR float64  `json:"psnr"`           // dB, capped at 100 for identical frames
+    VMAF *float64 `json:"vmaf,omitempty"` // Missing when not requested or libvmaf is unavailable
+}
+
+// LadderOptions selects how the renditions and their quality are chosen.
+// The fixed ladder encodes every requested resolution at the job's rate
+// control; the auto ladder test-encodes samples of each source and keeps
+// the rungs that reach the target quality with the fewest bits.
+type LadderOptions struct {
+    Mode           string  `json:"mode,omitempty"`           // "fixed" (default) or "auto"
+    TargetVMAF     float64 `json:"targetVmaf,omitempty"`     // Defaults to 93
+    TargetSSIM     float64 `json:"targetSsim,omitempty"`     // Used when ffmpeg has no libvmaf, defaults to 0.98
+    SampleCount    int     `json:"sampleCount,omitempty"`    // Samples taken across the source, defaults to 3
+    SampleDuration float64 `json:"sampleDuration,omitempty"` // Seconds per sample, defaults to 4
+    MinSpacing     float64 `json:"minSpacing,omitempty"`     // Minimum bitrate ratio between neighbouring rungs, defaults to 1.5
+}
+
+// LadderReport is the auto ladder chosen for one source and why
+type LadderReport struct {
+    Metric string       `json:"metric"` // vmaf or ssim
+    Target float64      `json:"target"`
+    Rungs  []LadderRung `json:"rungs"`
+}
+
+// LadderRung is the test encode result of one candidate resolution
+type LadderRung struct {
+    Resolution  Resolution `json:"resolution"`
+    Width       int        `json:"width"`
+    Height      int        `json:"height"`
+    CRF         int        `json:"crf,omitempty"`         // Highest CRF reaching the target
+    BitrateKbps int        `json:"bitrateKbps,omitempty"` // Sample bitrate at that CRF
+    Score       float64    `json:"score,omitempty"`
+    Selected    bool       `json:"selected"`
+    Reason      string     `json:"reason"`
+}
+
+// ChunkOptions splits each source into chunks encoded in parallel and
+// joined again without re-encoding. Made for slow encoders such as AV1.
+type ChunkOptions struct {
+    SplitAt       string  `json:"splitAt,omitempty"`       // "keyframes" (default) or "scenes"
+    ChunkDuration float64 `json:"chunkDuration,omitempty"` // Minimum seconds per chunk, defaults to 60
+    Parallel      int     `json:"parallel,omitempty"`      // Chunks encoded at once, defaults to half the CPU cores
+    Retries       int     `json:"retries,omitempty"`       // Extra attempts per failed chunk, defaults to 2
 }
 
 type MediaRequest struct {
+    Preset          string          `json:"preset,omitempty"` // Named preset the other fields override
     SourcePath      string          `json:"sourcePath"`
     CodecType       CodecType       `json:"codecType"`
     ContainerFormat ContainerFormat `json:"containerFormat"`
     Resolutions     []Resolution    `json:"resolutions"`
     DestinationPath string          `json:"destinationPath"`
     Filters         *VideoFilter    `json:"filters,omitempty"`
+    OutputMode      OutputMode      `json:"outputMode,omitempty"`
+    Packaging       *PackagingOptions `json:"packaging,omitempty"`
+    Thumbnails      *ThumbnailOptions `json:"thumbnails,omitempty"`
+    Audio           *AudioOptions   `json:"audio,omitempty"`
+    RateControl     *RateControl    `json:"rateControl,omitempty"`
+    ScaleMode       ScaleMode       `json:"scaleMode,omitempty"`
+    Subtitles       *SubtitleOptions `json:"subtitles,omitempty"`
+    Clips           []Clip          `json:"clips,omitempty"`
+    Concat          []string        `json:"concat,omitempty"` // Sources joined in order into one output; replaces sourcePath
+    Scenes          *SceneOptions   `json:"scenes,omitempty"`
+    Quality         *QualityOptions `json:"quality,omitempty"`
+    Ladder          *LadderOptions  `json:"ladder,omitempty"`
+    Chunking        *ChunkOptions   `json:"chunking,omitempty"`
+    Parallelism     int             `json:"parallelism,omitempty"` // Files of a directory processed at once, defaults to 1
+    ContinueOnError bool            `json:"continueOnError,omitempty"` // Keep going past failed files and renditions
+    Include         []string        `json:"include,omitempty"` // Globs a file in a source directory must match; with a slash they match the relative path, otherwise the name
+    Exclude         []string        `json:"exclude,omitempty"` // Globs for files and directories to leave out
+    Streams         *StreamOptions  `json:"streams,omitempty"`
 }
 
 type MediaJob struct {
     ID              string          `json:"id"`
+    Preset          string          `json:"preset,omitempty"`
     SourcePath      string          `json:"sourcePath"`
     CodecType       CodecType       `json:"codecType"`
     ContainerFormat ContainerFormat `json:"containerFormat"`
     Resolutions     []Resolution    `json:"resolutions"`
     DestinationPath string          `json:"destinationPath"`
     Filters         *VideoFilter    `json:"filters,omitempty"`
+    OutputMode      OutputMode      `json:"outputMode,omitempty"`
+    Packaging       *PackagingOptions `json:"packaging,omitempty"`
+    Thumbnails      *ThumbnailOptions `json:"thumbnails,omitempty"`
+    Audio           *AudioOptions   `json:"audio,omitempty"`
+    RateControl     *RateControl    `json:"rateControl,omitempty"`
+    ScaleMode       ScaleMode       `json:"scaleMode,omitempty"`
+    Subtitles       *SubtitleOptions `json:"subtitles,omitempty"`
+    Clips           []Clip          `json:"clips,omitempty"`
+    Concat          []string        `json:"concat,omitempty"` // Sources joined in order into one output; replaces sourcePath
+    Scenes          *SceneOptions   `json:"scenes,omitempty"`
+    Quality         *QualityOptions `json:"quality,omitempty"`
+    Ladder          *LadderOptions  `json:"ladder,omitempty"`
+    Chunking        *ChunkOptions   `json:"chunking,omitempty"`
+    Parallelism     int             `json:"parallelism,omitempty"`
+    ContinueOnError bool            `json:"continueOnError,omitempty"`
+    Include         []string        `json:"include,omitempty"`
+    Exclude         []string        `json:"exclude,omitempty"`
+    Streams         *StreamOptions  `json:"streams,omitempty"`
     Status          string          `json:"status"`
     CurrentFile     string          `json:"currentFile,omitempty"`
     ProcessedFiles  []string        `json:"processedFiles"`
+    Files           []*MediaFile    `json:"files"`
+    Skipped         []SkippedFile   `json:"skipped,omitempty"` // Files of a source directory left out, with the reason
+    Results         []MediaResult   `json:"results,omitempty"` // One line per rendition, filled in when the job finishes
+    Retries         int             `json:"retries,omitempty"` // Times the failed items were re-run
+    LaidOut         bool            `json:"-"`                 // Every source was turned into files, a retry need not walk again
+    Progress        JobProgress     `json:"progress"`
     StartTime       time.Time       `json:"startTime"`
     EndTime         time.Time       `json:"endTime,omitempty"`
     Error           string          `json:"error,omitempty"`
+
+    mu sync.Mutex // Held while parallel files and chunks update the job and while it is read
+}
+
+// Lock guards the job against parallel files and chunks writing it while
+// a handler serializes it
+func (j *MediaJob) Lock() {
+    j.mu.Lock()
+}
+
+func (j *MediaJob) Unlock() {
+    j.mu.Unlock()
+}
+
+// MediaPreset is a named set of encoding settings a request can start from.
+// Settings leave out everything tied to one job, such as paths and clips.
+type MediaPreset struct {
+    Name        string       `json:"name"`
+    Description string       `json:"description,omitempty"`
+    Settings    MediaRequest `json:"settings"`
+    CreatedAt   time.Time    `json:"createdAt"`
+    UpdatedAt   time.Time    `json:"updatedAt"`
 }
 
-func (r Resolution) GetDimensions() (width, height int) {
+// EncodeProgress is a snapshot of the key=value stream ffmpeg writes with -progress
+type EncodeProgress struct {
+    Percent     float64 `json:"percent"`
+    Frame       int64   `json:"frame,omitempty"`
+    FPS         float64 `json:"fps,omitempty"`
+    Speed       float64 `json:"speed,omitempty"`       // Multiple of realtime
+    BitrateKbps float64 `json:"bitrateKbps,omitempty"`
+    OutputSize  int64   `json:"outputSize,omitempty"`  // Bytes written so far
+    OutTime     float64 `json:"outTime,omitempty"`     // Seconds of media encoded
+    ETA         float64 `json:"eta,omitempty"`         // Seconds remaining
+}
+
+// RenditionOutput is one output file produced from a source file
+type RenditionOutput struct {
+    Resolution Resolution     `json:"resolution"`
+    OutputPath string         `json:"outputPath"`
+    Width      int            `json:"width,omitempty"`  // Output frame size, known once the source is probed
+    Height     int            `json:"height,omitempty"`
+    Bandwidth  int64          `json:"bandwidth,omitempty"` // Advertised bits per second in hls/dash mode
+    CRF        int            `json:"crf,omitempty"` // Per-rendition CRF picked by the auto ladder
+    Quality    *QualityScores `json:"quality,omitempty"`
+    Status     string         `json:"status"`
+    Error      string         `json:"error,omitempty"`
+    Size       int64          `json:"size,omitempty"`     // Bytes written, every segment included in hls mode
+    Duration   float64        `json:"duration,omitempty"` // Seconds, probed from the finished output
+    Progress   EncodeProgress `json:"progress"`
+}
+
+// MediaFile is one source file processed by a job
+type MediaFile struct {
+    Path       string             `json:"path"`
+    Name       string             `json:"name"`                // Base name of everything written for this file
+    Clip       *ClipRange         `json:"clip,omitempty"`
+    Duration   float64            `json:"duration,omitempty"` // Seconds, 0 when unknown
+    Probe      *ProbeResult       `json:"probe,omitempty"`
+    Manifest   string             `json:"manifest,omitempty"` // Master playlist or MPD in hls/dash mode
+    Previews   []PreviewImage     `json:"previews,omitempty"`
+    Loudness   *LoudnessMeasurement `json:"loudness,omitempty"` // Source loudness measured for loudnorm
+    SubtitleFiles []SubtitleFile  `json:"subtitleFiles,omitempty"`
+    Scenes     []Scene            `json:"scenes,omitempty"`
+    Ladder     *LadderReport      `json:"ladder,omitempty"`
+    Status     string             `json:"status"`
+    Error      string             `json:"error,omitempty"`
+    Renditions []*RenditionOutput `json:"renditions"`
+}
+
+// SkippedFile is a file a directory job did not process
+type SkippedFile struct {
+    Path   string `json:"path"`
+    Reason string `json:"reason"`
+}
+
+// MediaResult is the outcome of one rendition of one file. A file that
+// failed before or after its renditions gets a line without a resolution.
+type MediaResult struct {
+    File       string     `json:"file"`
+    Name       string     `json:"name,omitempty"`
+    Resolution Resolution `json:"resolution,omitempty"`
+    Status     string     `json:"status"`
+    OutputPath string     `json:"outputPath,omitempty"`
+    Size       int64      `json:"size,omitempty"`
+    Duration   float64    `json:"duration,omitempty"`
+    Error      string     `json:"error,omitempty"`
+}
+
+// JobProgress rolls the progress of every rendition up for the whole job
+type JobProgress struct {
+    EncodeProgress
+    CurrentResolution Resolution `json:"currentResolution,omitempty"`
+    FilesTotal        int        `json:"filesTotal"`
+    FilesCompleted    int        `json:"filesCompleted"`
+}
+
+var customResolution = regexp.MustCompile(`^([0-9]+)x([0-9]+)$`)
+var heightResolution = regexp.MustCompile(`^([0-9]+)p$`)
+
+// Dimensions returns the box a resolution asks for. Presets and "WxH" give
+// both sides; any other "<height>p" gives only the height and a width of 0,
+// the width then follows the source aspect ratio.
+func (r Resolution) Dimensions() (width, height int, err error) {
     switch r {
     case Res360p:
-        return 640, 360
+        return 640, 360, nil
     case Res480p:
-        return 854, 480
+        return 854, 480, nil
     case Res540p:
-        return 960, 540
+        return 960, 540, nil
     case Res720p:
-        return 1280, 720
+        return 1280, 720, nil
     case Res1080p:
-        return 1920, 1080
+        return 1920, 1080, nil
+    case Res1440p:
+        return 2560, 1440, nil
+    case Res2160p:
+        return 3840, 2160, nil
+    }
+
+    if m := customResolution.FindStringSubmatch(string(r)); m != nil {
+        width, _ = strconv.Atoi(m[1])
+        height, _ = strconv.Atoi(m[2])
+    } else if m := heightResolution.FindStringSubmatch(string(r)); m != nil {
+        height, _ = strconv.Atoi(m[1])
+    } else {
+        return 0, 0, fmt.Errorf("invalid resolution %q, expected a preset, WxH or <height>p", r)
+    }
+
+    if height < 16 || height > 8192 || (width != 0 && (width < 16 || width > 8192)) {
+        return 0, 0, fmt.Errorf("resolution %q is out of range", r)
+    }
+    return width, height, nil
+}
+
+// IsPreset reports whether the resolution is one of the named 16:9 sizes
+func (r Resolution) IsPreset() bool {
+    switch r {
+    case Res360p, Res480p, Res540p, Res720p, Res1080p, Res1440p, Res2160p:
+        return true
     default:
-        return 1280, 720 // Default to 720p
+        return false
     }
-}
\ No newline at end of file
+}
@@ -0,0 +1,75 @@
+package models
+
+type ProbeRequest struct {
+    Path string `json:"path"` // Media file to inspect
+}
+
+// ProbeResult describes a media file as reported by ffprobe
+type ProbeResult struct {
+    Container  string         `json:"container"`            // Short demuxer names, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+    FormatName string         `json:"formatName,omitempty"` // Human readable container name
+    Duration   float64        `json:"duration"`             // Seconds
+    Size       int64          `json:"size,omitempty"`       // Bytes
+    BitRate    int64          `json:"bitRate,omitempty"`    // Bits per second
+    Streams    []ProbeStream  `json:"streams"`
+    Chapters   []ProbeChapter `json:"chapters"`
+}
+
+type ProbeStream struct {
+    Index          int     `json:"index"`
+    Type           string  `json:"type"` // video, audio, subtitle, data or attachment
+    Codec          string  `json:"codec"`
+    Profile        string  `json:"profile,omitempty"`
+    BitRate        int64   `json:"bitRate,omitempty"`
+    Duration       float64 `json:"duration,omitempty"`
+    Language       string  `json:"language,omitempty"`
+    Title          string  `json:"title,omitempty"`
+    Default        bool    `json:"default,omitempty"`
+    Forced         bool    `json:"forced,omitempty"`
+    AttachedPic    bool    `json:"attachedPic,omitempty"` // Cover art rather than real video
+
+    // Video
+    Width          int     `json:"width,omitempty"`
+    Height         int     `json:"height,omitempty"`
+    FrameRate      float64 `json:"frameRate,omitempty"`
+    PixelFormat    string  `json:"pixelFormat,omitempty"`
+    ColorSpace     string  `json:"colorSpace,omitempty"`
+    ColorTransfer  string  `json:"colorTransfer,omitempty"`
+    ColorPrimaries string  `json:"colorPrimaries,omitempty"`
+    ColorRange     string  `json:"colorRange,omitempty"`
+    Rotation       int     `json:"rotation,omitempty"` // Clockwise degrees the player rotates the picture
+    SampleAspect   float64 `json:"sampleAspectRatio,omitempty"` // Width of one pixel relative to its height, 0 when square or unknown
+
+    // Audio
+    SampleRate     int     `json:"sampleRate,omitempty"`
+    Channels       int     `json:"channels,omitempty"`
+    ChannelLayout  string  `json:"channelLayout,omitempty"`
+}
+
+type ProbeChapter struct {
+    ID    int64   `json:"id"`
+    Start float64 `json:"start"` // Seconds
+    End   float64 `json:"end"`   // Seconds
+    Title string  `json:"title,omitempty"`
+}
+
+// VideoStream returns the first real video stream, skipping cover art
+func (p *ProbeResult) VideoStream() *ProbeStream {
+    for i := range p.Streams {
+        if p.Streams[i].Type == "video" && !p.Streams[i].AttachedPic {
+            return &p.Streams[i]
+        }
+    }
+    return nil
+}
+
+// StreamsOfType returns all streams of the given type in file order
+func (p *ProbeResult) StreamsOfType(streamType string) []ProbeStream {
+    var streams []ProbeStream
+    for _, stream := range p.Streams {
+        if stream.Type == streamType {
+            streams = append(streams, stream)
+        }
+    }
+    return streams
+}
@@ -2,23 +2,35 @@ package routes
 
 import (
     "github.com/gofiber/fiber/v2"
+    "task-automation-rig/config"
     "task-automation-rig/controllers"
 )
 
-func SetupRoutes(app *fiber.App) {
+func SetupRoutes(app *fiber.App, cfg *config.Config) {
     // Initialize controllers
-    backupController := controllers.NewBackupController()
-    mediaController := controllers.NewMediaController()
+    scheduler := controllers.NewScheduler(cfg)
+    backupController := controllers.NewBackupController(cfg, scheduler)
+    mediaController := controllers.NewMediaController(cfg, scheduler)
 
     // Backup routes
     backup := app.Group("/api/backups")
     backup.Post("/", backupController.CreateBackup)
     backup.Get("/", backupController.ListBackups)
+    backup.Get("/scrub", backupController.GetScrubReport)
+    backup.Post("/scrub", backupController.ScrubBackups)
     backup.Get("/:id", backupController.GetBackup)
+    backup.Post("/:id/repair", backupController.RepairBackup)
 
     // Media processing routes
     media := app.Group("/api/media")
     media.Post("/", mediaController.CreateMediaJob)
+    media.Post("/probe", mediaController.ProbeMedia)
+    media.Get("/presets", mediaController.ListPresets)
+    media.Post("/presets", mediaController.CreatePreset)
+    media.Get("/presets/:name", mediaController.GetPreset)
+    media.Put("/presets/:name", mediaController.UpdatePreset)
+    media.Delete("/presets/:name", mediaController.DeletePreset)
     media.Get("/", mediaController.ListMediaJobs)
     media.Get("/:id", mediaController.GetMediaJob)
+    media.Post("/:id/retry", mediaController.RetryMediaJob)
 }
\ No newline at end of file